@@ -35,3 +35,38 @@ func (e *Examples) PrivateGit_Push(git *dagger.Service, repo *dagger.Directory)
 		Repo(repo).
 		Push()
 }
+
+func (e *Examples) PrivateGit_CloneBySshAgent(git *dagger.Service, agent *dagger.Socket, knownHosts *dagger.File) *dagger.Directory {
+	credential := dag.SSHCredential().
+		WithAgent(agent).
+		WithKnownHosts(knownHosts)
+
+	return dag.
+		PrivateGit(dagger.PrivateGitOpts{
+			BaseCtr: dag.PrivateGit().BaseContainer().WithServiceBinding("gitea", git),
+		}).
+		WithSSHCredential(credential).
+		WithRepoURL("git@gitea:super/test.git").
+		Clone().
+		Directory()
+}
+
+func (e *Examples) PrivateGit_CloneWithKeyring(git *dagger.Service, giteaKey *dagger.Secret, githubKey *dagger.Secret) *dagger.Directory {
+	keyring := dag.SSHCredential().
+		Keyring().
+		WithIdentity("gitea", dag.SSHCredential().WithKey(giteaKey), dagger.SSHCredentialKeyringWithIdentityOpts{
+			Hosts: []string{"gitea"},
+		}).
+		WithIdentity("github", dag.SSHCredential().WithKey(githubKey), dagger.SSHCredentialKeyringWithIdentityOpts{
+			Hosts: []string{"github.com"},
+		})
+
+	return dag.
+		PrivateGit(dagger.PrivateGitOpts{
+			BaseCtr: dag.PrivateGit().BaseContainer().WithServiceBinding("gitea", git),
+		}).
+		WithSSHKeyring(keyring).
+		WithRepoURL("git@gitea:super/test.git").
+		Clone().
+		Directory()
+}
@@ -9,7 +9,6 @@ import (
 	"dagger/git/internal/dagger"
 	"fmt"
 	"strings"
-	"time"
 )
 
 // +private
@@ -19,20 +18,38 @@ const WorkDir = "/tmp/repo/"
 type PrivateGit struct {
 	// +private
 	BaseCtr *dagger.Container
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
 }
 
 func New(
 	// base container
 	// +optional
 	baseCtr *dagger.Container,
-) *PrivateGit {
-	git := &PrivateGit{}
+	// cache policy for clone, push and pull: always, key or forever
+	// +optional
+	// +default="always"
+	cachePolicy string,
+	// cache key, required by the "key" cache policy
+	// +optional
+	cacheKey string,
+) (*PrivateGit, error) {
+	if err := validateCachePolicy(cachePolicy, cacheKey); err != nil {
+		return nil, err
+	}
+
+	git := &PrivateGit{
+		CachePolicy: cachePolicy,
+		CacheKey:    cacheKey,
+	}
 	if baseCtr != nil {
 		git.BaseCtr = baseCtr
 	} else {
 		git.BaseCtr = git.BaseContainer()
 	}
-	return git
+	return git, nil
 }
 
 // Get the base container for the PrivateGit module.
@@ -50,8 +67,7 @@ func (g *PrivateGit) BaseContainer() *dagger.Container {
 		From("ubuntu:22.04").
 		WithWorkdir(WorkDir).
 		WithExec([]string{"apt", "update"}).
-		WithExec([]string{"apt", "install", "-y", "git"}).
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"apt", "install", "-y", "git", "openssh-client", "sshpass"}).
 		WithExec([]string{"git", "config", "--global", "--add", "--bool", "push.autoSetupRemote", "true"})
 }
 
@@ -60,8 +76,10 @@ func (g *PrivateGit) Repo(
 	dir *dagger.Directory,
 ) *PrivateGitRepo {
 	return &PrivateGitRepo{
-		BaseCtr: g.BaseCtr,
-		RepoDir: dir,
+		BaseCtr:     g.BaseCtr,
+		RepoDir:     dir,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}
 }
 
@@ -69,27 +87,81 @@ func (g *PrivateGit) Repo(
 //
 // Note: Tested against RSA-formatted and OPENSSH-formatted private keys.
 func (g *PrivateGit) WithSshKey(
+	ctx context.Context,
 	// ssk key file
 	sshKey *dagger.Secret,
-) *PrivateGitSsh {
-	keyPath := "/identity_key"
+) (*PrivateGitSsh, error) {
+	return g.WithSshCredential(ctx, dag.SSHCredential().WithKey(sshKey))
+}
+
+// Set the SSH credentials.
+func (g *PrivateGit) WithSshCredential(
+	ctx context.Context,
+	// credentials created with the ssh-credential module
+	credential *dagger.SSHCredential,
+) (*PrivateGitSsh, error) {
+	// The repository is not known yet, so the credential is used as the identity for any destination.
+	ctr, err := withSshAuth(ctx, g.BaseCtr, credential.Identity(""))
+	if err != nil {
+		return nil, err
+	}
 
 	return &PrivateGitSsh{
-		BaseCtr: g.BaseCtr.
-			WithMountedSecret(keyPath, sshKey).
-			WithEnvVariable("GIT_SSH_COMMAND", fmt.Sprintf("ssh -i %s -o StrictHostKeyChecking=no -o LogLevel=error", keyPath)),
+		BaseCtr:     ctr,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
+	}, nil
+}
+
+// Set the SSH credentials to the identities of a keyring.
+// The identity that matches the host of the repository URL is used.
+func (g *PrivateGit) WithSshKeyring(
+	// keyring created with the ssh-credential module
+	keyring *dagger.SSHCredentialKeyring,
+) *PrivateGitSsh {
+	return &PrivateGitSsh{
+		BaseCtr:     g.BaseCtr,
+		Keyring:     keyring,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}
 }
 
+// Returns ctr with the credential files of the identity mounted at its path, and GIT_SSH_COMMAND using them.
+func withSshAuth(ctx context.Context, ctr *dagger.Container, identity *dagger.SSHCredentialIdentity) (*dagger.Container, error) {
+	mountPath, err := identity.Path(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credential := identity.Credential()
+
+	args, err := credential.Command(ctx, "ssh", mountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, "-o", "LogLevel=error")
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		// GIT_SSH_COMMAND is run by the shell
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+	}
+
+	return credential.Mount(ctr, mountPath).
+		WithEnvVariable("GIT_SSH_COMMAND", strings.Join(quoted, " ")), nil
+}
+
 // Set up user and password information.
 func (g *PrivateGit) WithUserPassword(
 	username string,
 	password *dagger.Secret,
 ) *PrivateGitHttp {
 	return &PrivateGitHttp{
-		BaseCtr:  g.BaseCtr,
-		Username: username,
-		Password: password,
+		BaseCtr:     g.BaseCtr,
+		Username:    username,
+		Password:    password,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}
 }
 
@@ -97,26 +169,71 @@ func (g *PrivateGit) WithUserPassword(
 type PrivateGitSsh struct {
 	// +private
 	BaseCtr *dagger.Container
+	// +private
+	Keyring *dagger.SSHCredentialKeyring
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
 }
 
 // Set the SSH URL of the target repository.
 func (g *PrivateGitSsh) WithRepoUrl(
+	ctx context.Context,
 	sshUrl string,
-) *PrivateGitRepoUrl {
-	return &PrivateGitRepoUrl{
-		BaseCtr: g.BaseCtr,
-		RepoUrl: sshUrl,
+) (*PrivateGitRepoUrl, error) {
+	ctr, err := g.container(ctx, sshUrl)
+	if err != nil {
+		return nil, err
 	}
+
+	return &PrivateGitRepoUrl{
+		BaseCtr:     ctr,
+		RepoUrl:     sshUrl,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
+	}, nil
 }
 
 // Set up an existing repository folder.
+// With a keyring, the identity is selected by the URL of the 'origin' remote, or is the one without host patterns.
 func (g *PrivateGitSsh) Repo(
+	ctx context.Context,
 	dir *dagger.Directory,
-) *PrivateGitRepo {
+) (*PrivateGitRepo, error) {
+	repoUrl := ""
+	if g.Keyring != nil {
+		out, err := g.BaseCtr.
+			WithDirectory(WorkDir, dir).
+			WithExec([]string{"sh", "-c", "git config --get remote.origin.url || true"}).
+			Stdout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		repoUrl = strings.TrimSpace(out)
+	}
+
+	ctr, err := g.container(ctx, repoUrl)
+	if err != nil {
+		return nil, err
+	}
+
 	return &PrivateGitRepo{
-		BaseCtr: g.BaseCtr,
-		RepoDir: dir,
+		BaseCtr:     ctr,
+		RepoDir:     dir,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
+	}, nil
+}
+
+// Returns the container that connects to the repository at repoUrl,
+// using the identity of the keyring that matches its host if a keyring is set.
+func (g *PrivateGitSsh) container(ctx context.Context, repoUrl string) (*dagger.Container, error) {
+	if g.Keyring == nil {
+		return g.BaseCtr, nil
 	}
+
+	return withSshAuth(ctx, g.BaseCtr, g.Keyring.Identity(repoUrl))
 }
 
 // PrivateGit with user and password information added
@@ -127,6 +244,10 @@ type PrivateGitHttp struct {
 	Username string
 	// +private
 	Password *dagger.Secret
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
 }
 
 // Set the Web URL of the target repository.
@@ -140,8 +261,10 @@ func (g *PrivateGitHttp) WithRepoUrl(
 	}
 
 	return &PrivateGitRepoUrl{
-		BaseCtr: g.BaseCtr,
-		RepoUrl: strings.ReplaceAll(webUrl, "://", fmt.Sprintf("://%s:%s@", g.Username, passwordPlain)),
+		BaseCtr:     g.BaseCtr,
+		RepoUrl:     strings.ReplaceAll(webUrl, "://", fmt.Sprintf("://%s:%s@", g.Username, passwordPlain)),
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}, nil
 }
 
@@ -150,8 +273,10 @@ func (g *PrivateGitHttp) Repo(
 	dir *dagger.Directory,
 ) *PrivateGitRepo {
 	return &PrivateGitRepo{
-		BaseCtr: g.BaseCtr,
-		RepoDir: dir,
+		BaseCtr:     g.BaseCtr,
+		RepoDir:     dir,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}
 }
 
@@ -161,6 +286,27 @@ type PrivateGitRepoUrl struct {
 	BaseCtr *dagger.Container
 	// +private
 	RepoUrl string
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
+}
+
+// Set the cache policy for the clone.
+func (g *PrivateGitRepoUrl) WithCachePolicy(
+	// cache policy: always, key or forever
+	policy string,
+	// cache key, required by the "key" policy
+	// +optional
+	key string,
+) (*PrivateGitRepoUrl, error) {
+	if err := validateCachePolicy(policy, key); err != nil {
+		return nil, err
+	}
+
+	g.CachePolicy = policy
+	g.CacheKey = key
+	return g, nil
 }
 
 // Clone the Git repository.
@@ -168,6 +314,7 @@ func (g *PrivateGitRepoUrl) Clone(
 	ctx context.Context,
 ) (*PrivateGitRepo, error) {
 	repoDir, err := g.BaseCtr.
+		With(withCachePolicy(g.CachePolicy, g.CacheKey)).
 		WithExec([]string{"git", "clone", g.RepoUrl, "."}).
 		Directory(WorkDir).
 		Sync(ctx)
@@ -176,8 +323,10 @@ func (g *PrivateGitRepoUrl) Clone(
 	}
 
 	return &PrivateGitRepo{
-		BaseCtr: g.BaseCtr,
-		RepoDir: repoDir,
+		BaseCtr:     g.BaseCtr,
+		RepoDir:     repoDir,
+		CachePolicy: g.CachePolicy,
+		CacheKey:    g.CacheKey,
 	}, nil
 }
 
@@ -187,6 +336,10 @@ type PrivateGitRepo struct {
 	BaseCtr *dagger.Container
 	// +private
 	RepoDir *dagger.Directory
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
 }
 
 // Returns the container with RepoDir.
@@ -211,10 +364,28 @@ func (g *PrivateGitRepo) SetConfig(
 	return g
 }
 
+// Set the cache policy for push and pull.
+func (g *PrivateGitRepo) WithCachePolicy(
+	// cache policy: always, key or forever
+	policy string,
+	// cache key, required by the "key" policy
+	// +optional
+	key string,
+) (*PrivateGitRepo, error) {
+	if err := validateCachePolicy(policy, key); err != nil {
+		return nil, err
+	}
+
+	g.CachePolicy = policy
+	g.CacheKey = key
+	return g, nil
+}
+
 // Push the repository.
 func (g *PrivateGitRepo) Push() *dagger.Container {
 	return g.BaseCtr.
 		WithDirectory(WorkDir, g.RepoDir).
+		With(withCachePolicy(g.CachePolicy, g.CacheKey)).
 		WithExec([]string{"git", "push"})
 }
 
@@ -222,6 +393,7 @@ func (g *PrivateGitRepo) Push() *dagger.Container {
 func (g *PrivateGitRepo) Pull() *dagger.Directory {
 	return g.BaseCtr.
 		WithDirectory(WorkDir, g.RepoDir).
+		With(withCachePolicy(g.CachePolicy, g.CacheKey)).
 		WithExec([]string{"git", "pull"}).
 		Directory(WorkDir)
 }
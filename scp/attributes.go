@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"regexp"
+)
+
+// Remote script that applies "$mode" and "$owner" to the uploaded file "$f".
+const fileAttributesScript = `
+sudo=; [ "$(id -u)" -eq 0 ] || sudo="sudo -n"
+if [ -n "$mode" ]; then chmod "$mode" "$f" || exit 1; fi
+if [ -n "$owner" ]; then $sudo chown "$owner" "$f" || exit 1; fi
+`
+
+// Local shell script that writes the NUL-separated paths below "$1", relative to it, to the rest of "$@".
+// Unless "$2" is 0, the directory itself is listed as '.'.
+const uploadedPathsScript = `
+set -o pipefail
+dir=$1; root=$2; shift 2
+{ [ "$root" = 0 ] || printf '.\0'; cd "$dir" && find . -mindepth 1 -print0; } | "$@"
+`
+
+// Remote script that applies "$mode" to the regular files and "$owner" to all of the uploaded paths read from stdin,
+// relative to the uploaded directory "$base". Other files in the directory are left unchanged.
+const directoryAttributesScript = `
+sudo=; [ "$(id -u)" -eq 0 ] || sudo="sudo -n"
+cd "$base" || exit 1
+list=$(mktemp) || exit 1
+trap 'rm -f "$list"' EXIT
+cat > "$list"
+if [ -n "$mode" ]; then
+	xargs -0 -r sh -c 'for p; do if [ -f "$p" ] && [ ! -L "$p" ]; then printf "%s\0" "$p"; fi; done' sh < "$list" |
+		xargs -0 -r chmod "$mode" || exit 1
+fi
+if [ -n "$owner" ]; then xargs -0 -r $sudo chown -h "$owner" < "$list" || exit 1; fi
+`
+
+var modePattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// Validate a file mode given in octal.
+func validateMode(mode string) error {
+	if mode != "" && !modePattern.MatchString(mode) {
+		return fmt.Errorf("invalid mode %q: use octal digits (e.g. 0755)", mode)
+	}
+	return nil
+}
+
+// Set the mode and owner of the file name uploaded to target.
+func (s *ScpCommander) setFileAttributes(
+	ctx context.Context,
+	ctr *dagger.Container,
+	name string,
+	target string,
+	mode string,
+	owner string,
+) (*dagger.Container, error) {
+	if mode == "" && owner == "" {
+		return ctr, nil
+	}
+
+	script := fmt.Sprintf("mode=%s\nowner=%s\n%s", shellQuote(mode), shellQuote(owner), fileAttributesScript)
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "attributes",
+		Target:   target,
+	}, "", s.sshExec(uploadedFileScript(target, name, script)))
+}
+
+// Set the mode of the uploaded files and the owner of the uploaded paths of the local directory localDir,
+// uploaded as name to target. The uploaded directory itself is only changed if root is set, as when the upload created it.
+func (s *ScpCommander) setDirectoryAttributes(
+	ctx context.Context,
+	ctr *dagger.Container,
+	localDir string,
+	name string,
+	target string,
+	nested bool,
+	root bool,
+	mode string,
+	owner string,
+) (*dagger.Container, error) {
+	if mode == "" && owner == "" {
+		return ctr, nil
+	}
+
+	rootFlag := "0"
+	if root {
+		rootFlag = "1"
+	}
+	script := fmt.Sprintf("mode=%s\nowner=%s\n%s", shellQuote(mode), shellQuote(owner), directoryAttributesScript)
+	args := append([]string{"bash", "-c", uploadedPathsScript, "paths", localDir, rootFlag}, s.sshExec(uploadedDirectoryScript(target, name, nested, script))...)
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "attributes",
+		Source:   localDir,
+		Target:   target,
+	}, localDir, args)
+}
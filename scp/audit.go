@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// +private
+const AuditLogPath = "/var/log/dagger-scp-audit.jsonl"
+
+// Placeholder written to the audit transcript in place of secret values.
+const redacted = "[REDACTED]"
+
+// Records a single transfer in the audit transcript.
+// Timestamps, exit code and the size of the local side are filled in by the shell at run time.
+// The exit code of the transfer is passed on, so the exec is run expecting any exit code.
+const auditScript = `
+started=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+"$@"
+code=$?
+finished=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+bytes=$(du -sb "$AUDIT_LOCAL_PATH" 2>/dev/null | cut -f1)
+mkdir -p "$(dirname "$AUDIT_LOG")"
+printf '%s,"started_at":"%s","finished_at":"%s","exit_code":%d,"bytes":%d}\n' \
+	"$AUDIT_ENTRY" "$started" "$finished" "$code" "${bytes:-0}" >>"$AUDIT_LOG"
+exit $code
+`
+
+// Static part of an audit record, known before the transfer runs.
+type auditEntry struct {
+	Destination string `json:"destination"`
+	// upload or download
+	Transfer string `json:"transfer"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+}
+
+// Run args in ctr and append an audit record for it to AuditLogPath.
+// localPath is the file or directory in ctr whose size is recorded.
+// The record is written even if the transfer fails, in which case the returned error contains the record.
+func auditExec(ctx context.Context, ctr *dagger.Container, entry auditEntry, localPath string, args []string) (*dagger.Container, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = ctr.
+		WithEnvVariable("AUDIT_LOG", AuditLogPath).
+		WithEnvVariable("AUDIT_ENTRY", strings.TrimSuffix(string(b), "}")).
+		WithEnvVariable("AUDIT_LOCAL_PATH", localPath).
+		WithExec(append([]string{"bash", "-c", auditScript, "audit"}, args...), dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	code, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, auditError(ctx, ctr, code)
+	}
+
+	return ctr.
+		WithoutEnvVariable("AUDIT_LOCAL_PATH").
+		WithoutEnvVariable("AUDIT_ENTRY").
+		WithoutEnvVariable("AUDIT_LOG"), nil
+}
+
+// Returns the error of a failed audited exec in ctr, with its stderr and audit record.
+func auditError(ctx context.Context, ctr *dagger.Container, code int) error {
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return err
+	}
+	log, err := ctr.File(AuditLogPath).Contents(ctx)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	return fmt.Errorf("exit code %d: %s\naudit record: %s", code, strings.TrimSpace(stderr), lines[len(lines)-1])
+}
+
+// Replace every secret value in the given texts with a placeholder.
+func redact(ctx context.Context, secrets []*dagger.Secret, texts ...*string) error {
+	for _, secret := range secrets {
+		plain, err := secret.Plaintext(ctx)
+		if err != nil {
+			return err
+		}
+		if plain == "" {
+			continue
+		}
+		for _, text := range texts {
+			*text = strings.ReplaceAll(*text, plain, redacted)
+		}
+	}
+	return nil
+}
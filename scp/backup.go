@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+)
+
+// Remote shell snippet that resolves "$p" to the path written by the upload:
+// "$p/$name" when "$p" is an existing directory and a file name is given.
+// It also sets "$archive", the name prefix of the backup archives of "$p", which includes a checksum of its absolute path
+// so that paths with the same base name can be archived in the same directory.
+// The absolute path is normalized without resolving symlinks, so 'app.conf', './app.conf' and '$HOME//app.conf' share their archives.
+const backupPathSnippet = `
+p=${p%/}
+[ -n "$name" ] && [ -d "$p" ] && p="$p/$name"
+case "$p" in /*) abs=$p ;; *) abs="$PWD/$p" ;; esac
+abs=$(printf '%s\n' "$abs" | awk -F/ '{
+	n = 0
+	for (i = 1; i <= NF; i++) {
+		if ($i == "" || $i == ".") continue
+		if ($i == "..") { if (n > 0) n--; continue }
+		part[++n] = $i
+	}
+	out = ""
+	for (i = 1; i <= n; i++) out = out "/" part[i]
+	print (out == "" ? "/" : out)
+}')
+archive="$(basename "$abs").$(printf '%s' "$abs" | cksum | cut -d ' ' -f 1)"
+`
+
+// Remote script that backs up "$p" before it is overwritten.
+// The backup is a copy named '$p.[timestamp]', or a '[name].[checksum].[timestamp].tar.gz' archive in "$dir" if given.
+// Nothing is done if "$p" does not exist.
+const backupScript = backupPathSnippet + `
+[ -e "$p" ] || [ -L "$p" ] || exit 0
+stamp=$(date -u +%Y%m%d%H%M%S)
+if [ -n "$dir" ]; then
+	backup="$dir/$archive.$stamp.tar.gz"
+else
+	backup="$p.$stamp"
+fi
+if [ -e "$backup" ]; then
+	echo "backup $backup already exists" >&2
+	exit 1
+fi
+if [ -n "$dir" ]; then
+	mkdir -p -- "$dir" && tar -C "$(dirname "$p")" -czf "$backup" -- "$(basename "$p")" || exit 1
+else
+	cp -a -- "$p" "$backup" || exit 1
+fi
+echo "backup $p -> $backup"
+`
+
+// Remote script that replaces "$p" with its most recent backup and removes that backup.
+const restoreBackupScript = backupPathSnippet + `
+src="$dir"; prefix="$archive."; suffix=.tar.gz
+[ -n "$dir" ] || { src=$(dirname "$p"); prefix="$(basename "$p")."; suffix=; }
+latest=$(ls -1A "$src" 2>/dev/null | prefix="$prefix" suffix="$suffix" awk '
+	BEGIN { prefix = ENVIRON["prefix"]; suffix = ENVIRON["suffix"] }
+	index($0, prefix) == 1 {
+		stamp = substr($0, length(prefix) + 1, 14)
+		if (length(stamp) == 14 && stamp ~ /^[0-9]+$/ && substr($0, length(prefix) + 15) == suffix) print
+	}
+' | sort | tail -n 1)
+if [ -z "$latest" ]; then
+	echo "no backup of $p in $src" >&2
+	exit 1
+fi
+rm -rf -- "$p" || exit 1
+if [ -n "$dir" ]; then
+	tar -C "$(dirname "$p")" -xzpf "$dir/$latest" && rm -f -- "$dir/$latest" || exit 1
+else
+	mv -- "$src/$latest" "$p" || exit 1
+fi
+echo "restored $p <- $src/$latest"
+`
+
+// Put the most recent backup of a remote path back in place, replacing the current content.
+// The restored backup is removed, so restoring again goes one backup further back.
+//
+// Note: Requires a shell and tar on the remote server.
+func (s *ScpCommander) RestoreBackup(
+	ctx context.Context,
+	// remote path that was backed up (for a file uploaded into a directory, the path of the file)
+	path string,
+	// directory on the remote server that holds the backup archives
+	// (If not entered, the backup next to the path is restored)
+	// +optional
+	backupDir string,
+) (*dagger.Container, error) {
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey))
+
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "restore",
+		Source:   backupDir,
+		Target:   path,
+	}, "", s.sshExec(backupVars(path, "", backupDir)+restoreBackupScript))
+}
+
+// Back up the remote target in ctr before the upload of name.
+// Name is only used when the target is an existing directory, and should be empty for directory uploads.
+func (s *ScpCommander) backup(ctx context.Context, ctr *dagger.Container, target string, name string, backupDir string) (*dagger.Container, error) {
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "backup",
+		Source:   target,
+		Target:   backupDir,
+	}, "", s.sshExec(backupVars(target, name, backupDir)+backupScript))
+}
+
+// Returns the variables of the backup scripts.
+func backupVars(path string, name string, backupDir string) string {
+	return fmt.Sprintf("p=%s\nname=%s\ndir=%s\n", shellQuote(path), shellQuote(name), shellQuote(backupDir))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Remote script that writes the files "$@" to stdout as a compressed tar stream, following symlinks as scp does.
+const tarFilesSourceScript = `
+for p; do
+	if [ -d "$p" ]; then echo "$p: not a regular file" >&2; exit 1; fi
+done
+exec tar -czhf - -- "$@"
+`
+
+// Local shell script that extracts the tar stream written by "$@" into "$1", keeping only the base names of the files.
+const tarDownloadFlatScript = `
+set -o pipefail
+dir=$1; shift
+mkdir -p "$dir"
+"$@" | tar -C "$dir" -xzpf - --transform='s,.*/,,'
+`
+
+// Copy several files to a remote directory in a single scp session, keeping their names.
+//
+// Note: The target directory must already exist.
+func (s *ScpCommander) FilesToRemote(
+	ctx context.Context,
+	// source files
+	files []*dagger.File,
+	// destination directory
+	// (If not entered, '.' is used as the default)
+	// +optional
+	target string,
+) (*dagger.Container, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no source files")
+	}
+	if target == "" {
+		target = "."
+	}
+
+	sourcePath := "/source-files"
+	dir := dag.Directory()
+	names := map[string]bool{}
+	for _, file := range files {
+		name, err := file.Name(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate file name %q", name)
+		}
+		names[name] = true
+		dir = dir.WithFile(name, file)
+	}
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithDirectory(sourcePath, dir)
+
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "upload",
+		Source:   sourcePath,
+		Target:   target,
+	}, sourcePath, append([]string{"bash", "-c", copyContentsScript, "copy", sourcePath, s.Destination + ":" + target}, s.scpCommand(false)...))
+}
+
+// Copy several files from a remote server as one tar stream over a single ssh channel.
+// The files are returned in a directory under their base names.
+//
+// Note: Requires a shell and tar on the remote server.
+func (s *ScpCommander) FilesFromRemote(
+	ctx context.Context,
+	// source paths
+	paths []string,
+) (*dagger.Directory, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no source paths")
+	}
+
+	targetPath := "/target-files"
+	names := map[string]bool{}
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		name := path.Base(p)
+		if names[name] {
+			return nil, fmt.Errorf("duplicate file name %q", name)
+		}
+		names[name] = true
+		quoted[i] = shellQuote(p)
+	}
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey))
+
+	remote := fmt.Sprintf("set -- %s\n%s", strings.Join(quoted, " "), tarFilesSourceScript)
+	args := append([]string{"bash", "-c", tarDownloadFlatScript, "tar-download", targetPath}, s.sshStream(streamDownload, remote)...)
+	ctr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "download",
+		Source:   strings.Join(paths, " "),
+		Target:   targetPath,
+	}, targetPath, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctr.Directory(targetPath), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"time"
+)
+
+// Cache policies for remote operations.
+const (
+	// Always run the operation (default)
+	CachePolicyAlways = "always"
+	// Run once per user-provided cache key
+	CachePolicyKey = "key"
+	// Run once and reuse the cached result forever
+	CachePolicyForever = "forever"
+)
+
+// Validate a cache policy and its key.
+func validateCachePolicy(policy string, key string) error {
+	switch policy {
+	case CachePolicyAlways, CachePolicyForever:
+		return nil
+	case CachePolicyKey:
+		if key == "" {
+			return fmt.Errorf("cache policy %q requires a cache key", policy)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown cache policy %q (expected %q, %q or %q)", policy, CachePolicyAlways, CachePolicyKey, CachePolicyForever)
+	}
+}
+
+// Returns a function that sets CACHE_BUSTER on a container according to the cache policy.
+func withCachePolicy(policy string, key string) dagger.WithContainerFunc {
+	return func(ctr *dagger.Container) *dagger.Container {
+		switch policy {
+		case CachePolicyKey:
+			return ctr.WithEnvVariable("CACHE_BUSTER", key)
+		case CachePolicyForever:
+			return ctr.WithoutEnvVariable("CACHE_BUSTER")
+		default:
+			return ctr.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+)
+
+// Copy a file or directory from a container to a remote server.
+// A directory is copied like DirectoryToRemote, a file like FileToRemote.
+func (s *ScpCommander) ContainerPathToRemote(
+	ctx context.Context,
+	// container holding the path
+	ctr *dagger.Container,
+	// path of a file or directory in the container
+	path string,
+	// destination path
+	// (If not entered, '.' is used as the default)
+	// +optional
+	target string,
+	// copy mode for a directory: contents (into the target) or subdirectory (into '[target]/[name]')
+	// (If not entered, the contents of a directory are copied into the target)
+	// +optional
+	copyMode string,
+	// subdirectory name for the subdirectory copy mode
+	// +optional
+	name string,
+) (*TransferResult, error) {
+	if target == "" {
+		target = "."
+	}
+
+	// The other transfer options are left at their defaults.
+	dir := ctr.Directory(path)
+	if _, err := dir.Sync(ctx); err == nil {
+		// Unlike DirectoryToRemote, which would nest the contents in '[target]/source-dir', copy them into the target by default.
+		if copyMode == "" {
+			copyMode = CopyContents
+		}
+		return s.DirectoryToRemote(ctx, dir, target, false, nil, nil, false, "", "", copyMode, name, false, false, "")
+	}
+
+	file := ctr.File(path)
+	if _, err := file.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("%s: not a file or directory in container: %w", path, err)
+	}
+	if copyMode != "" {
+		return nil, fmt.Errorf("%s: copy mode %q only applies to directories", path, copyMode)
+	}
+	return s.FileToRemote(ctx, file, target, false, false, "", "", false, "")
+}
+
+// Copy a file or directory from a remote server into a container.
+//
+// Returns the container with the downloaded file or directory at the given path.
+func (s *ScpCommander) RemotePathToContainer(
+	ctx context.Context,
+	// remote source path
+	source string,
+	// container to copy into
+	ctr *dagger.Container,
+	// path in the container
+	path string,
+	// the source is a directory
+	// +optional
+	directory bool,
+) (*dagger.Container, error) {
+	if directory {
+		// Download the whole directory with scp.
+		dir, err := s.DirectoryFromRemote(ctx, source, nil, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		return ctr.WithDirectory(path, dir), nil
+	}
+
+	file, err := s.FileFromRemote(ctx, source, "")
+	if err != nil {
+		return nil, err
+	}
+	return ctr.WithFile(path, file), nil
+}
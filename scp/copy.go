@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Directory copy modes
+const (
+	// Copy the contents of the source directory into the target
+	CopyContents = "contents"
+	// Copy the source directory as a named subdirectory of the target
+	CopySubdirectory = "subdirectory"
+)
+
+// Local shell script that copies every top-level entry of "$1", including hidden ones, to "$2" with the scp command "$@".
+// Nothing is copied from an empty directory.
+const copyContentsScript = `
+shopt -s dotglob nullglob
+dir=$1; dest=$2; shift 2
+entries=("$dir"/*)
+[ ${#entries[@]} -eq 0 ] || "$@" -r "${entries[@]}" "$dest"
+`
+
+// Validate a directory copy mode and its subdirectory name.
+func validateCopyMode(copyMode string, name string) error {
+	switch copyMode {
+	case "", CopyContents:
+		return nil
+	case CopySubdirectory:
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("copy mode %q requires a subdirectory name without '/'", copyMode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown copy mode %q (expected %q or %q)", copyMode, CopyContents, CopySubdirectory)
+	}
+}
+
+// Create the directory target and its parents on the remote server.
+// This uses sftp rather than a remote shell, so it also works with SFTP-only accounts.
+func (s *ScpCommander) mkdir(ctx context.Context, ctr *dagger.Container, target string) (*dagger.Container, error) {
+	batchPath := "/tmp/sftp-mkdir"
+	args := append(append([]string{}, s.SftpBaseCommand...), "-b", batchPath, s.Destination)
+	return s.exec(ctx, ctr.WithNewFile(batchPath, mkdirBatch(target)), auditEntry{
+		Transfer: "mkdir",
+		Target:   target,
+	}, "", args)
+}
+
+// Returns the sftp batch that creates target and its parents.
+// Failures to create a directory are ignored (it may already exist); the final cd fails if target is still missing.
+func mkdirBatch(target string) string {
+	var b strings.Builder
+	dir := ""
+	if strings.HasPrefix(target, "/") {
+		dir = "/"
+	}
+	for _, part := range strings.Split(target, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		dir = path.Join(dir, part)
+		fmt.Fprintf(&b, "-mkdir %s\n", sftpQuote(dir))
+	}
+	fmt.Fprintf(&b, "cd %s\n", sftpQuote(target))
+	return b.String()
+}
+
+// Quote s for an sftp batch command.
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Local shell script that streams a tar archive from the source server ("$1") to the target server (the rest of "$@").
+// The two ssh commands are separated by a '--' argument.
+const copyToScript = `
+set -o pipefail
+src=()
+while [ "$1" != "--" ]; do src+=("$1"); shift; done
+shift
+"${src[@]}" | "$@"
+`
+
+// Remote script that writes "$name" below "$dir" to stdout as a tar archive, passing "$@" as additional tar options.
+const tarSourceScript = `
+tar -C "$dir" -c${z}f - "$@" -- "$name"
+`
+
+// Remote script that extracts a tar archive from stdin into "$t".
+const tarTargetScript = `
+mkdir -p -- "$t" && tar -C "$t" -x${z}pf -
+`
+
+// Copy a file or directory from this remote server directly to another one,
+// streaming a tar archive between them instead of storing the data in a Dagger layer.
+// The source is copied into the target directory, which is created if needed.
+// The bandwidth limit of this commander applies to the stream.
+//
+// Note: Requires a shell and tar on both servers. The other server must be reachable from this commander's container.
+func (s *ScpCommander) CopyTo(
+	ctx context.Context,
+	// commander for the target server
+	other *ScpCommander,
+	// source path on this server
+	sourcePath string,
+	// target directory on the other server
+	targetPath string,
+) (*dagger.Container, error) {
+	otherPath := other.IdentityPath
+	if otherPath == s.IdentityPath {
+		// Both commanders connect to the same destination, possibly with different credentials.
+		otherPath += "-target"
+	}
+	otherSsh, err := authCommand(ctx, other.Credential, otherPath, "ssh", "-p", other.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr := other.Credential.Mount(s.BaseCtr, otherPath).
+		With(withCachePolicy(s.CachePolicy, s.CacheKey))
+
+	z := ""
+	if s.Compress {
+		z = "z"
+	}
+	source := strings.TrimSuffix(sourcePath, "/")
+	sourceScript := fmt.Sprintf("dir=%s\nname=%s\nz=%s\n%s", shellQuote(path.Dir(source)), shellQuote(path.Base(source)), z, tarSourceScript)
+	targetScript := fmt.Sprintf("t=%s\nz=%s\n%s", shellQuote(targetPath), z, tarTargetScript)
+
+	args := []string{"bash", "-c", copyToScript, "copy-to"}
+	args = append(args, s.sshStream(streamDownload, sourceScript)...)
+	args = append(args, "--")
+	args = append(args, append(otherSsh, other.Destination, targetScript)...)
+
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "copy",
+		Source:   sourcePath,
+		Target:   other.Destination + ":" + targetPath,
+	}, "", args)
+}
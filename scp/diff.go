@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Local shell script that prints the SHA-256 manifest of the files below "$1".
+const localManifestScript = `
+cd "$1" && find . -type f -print0 | sort -z | xargs -0 -r sha256sum
+`
+
+// Remote script that prints the SHA-256 manifest of the files below "$t", or nothing if it does not exist.
+const remoteManifestScript = `
+cd "$t" 2>/dev/null || exit 0
+find . -type f -exec sha256sum {} +
+`
+
+// Local shell script that appends unified diffs between the remote copies in "$1" and the local files in "$2"
+// of the paths listed in the rest of "$@" to "$DIFF_REPORT".
+const unifiedDiffScript = `
+remote=$1; local=$2; shift 2
+for f in "$@"; do
+	diff -u --label "remote/$f" --label "local/$f" "$remote/$f" "$local/$f" >> "$DIFF_REPORT"
+	[ $? -le 1 ] || exit 1
+done
+exit 0
+`
+
+// Differences between a local directory and a remote path
+type DiffResult struct {
+	// files that exist only locally
+	Added []string
+	// files whose contents differ
+	Modified []string
+	// files that exist only on the remote server
+	Deleted []string
+	// report listing the changes, followed by unified diffs if requested
+	Report *dagger.File
+}
+
+// Compare a directory with a remote path without modifying the remote server.
+// Files are compared by SHA-256 checksum.
+//
+// Note: Requires a shell and sha256sum on the remote server, and tar for unified diffs.
+func (s *ScpCommander) Diff(
+	ctx context.Context,
+	// local directory
+	source *dagger.Directory,
+	// remote path to compare with
+	target string,
+	// include unified diffs of the modified files in the report
+	// +optional
+	unified bool,
+) (*DiffResult, error) {
+	sourcePath := "/source-dir"
+	remotePath := "/remote-dir"
+	reportPath := "/diff-report.txt"
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithDirectory(sourcePath, source)
+
+	localOut, err := ctr.
+		WithExec([]string{"bash", "-c", localManifestScript, "manifest", sourcePath}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteCtr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "diff",
+		Source:   sourcePath,
+		Target:   target,
+	}, "", s.sshExec(fmt.Sprintf("t=%s\n%s", shellQuote(target), remoteManifestScript)))
+	if err != nil {
+		return nil, err
+	}
+	remoteOut, err := remoteCtr.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	local := parseManifest(localOut)
+	remote := parseManifest(remoteOut)
+	result := &DiffResult{
+		Added:    []string{},
+		Modified: []string{},
+		Deleted:  []string{},
+	}
+	for name, hash := range local {
+		remoteHash, ok := remote[name]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, name)
+		case remoteHash != hash:
+			result.Modified = append(result.Modified, name)
+		}
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			result.Deleted = append(result.Deleted, name)
+		}
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Modified)
+	sort.Strings(result.Deleted)
+
+	ctr = ctr.WithNewFile(reportPath, diffReport(target, result))
+	if unified && len(result.Modified) > 0 {
+		ctr, err = s.exec(ctx, ctr, auditEntry{
+			Transfer: "download",
+			Source:   target,
+			Target:   remotePath,
+		}, remotePath, s.tarDownloadFilesCommand(target, result.Modified, remotePath))
+		if err != nil {
+			return nil, err
+		}
+		ctr = ctr.
+			WithEnvVariable("DIFF_REPORT", reportPath).
+			WithExec(append([]string{"bash", "-c", unifiedDiffScript, "diff", remotePath, sourcePath}, result.Modified...)).
+			WithoutEnvVariable("DIFF_REPORT")
+	}
+	result.Report = ctr.File(reportPath)
+
+	return result, nil
+}
+
+// Returns the command that downloads the given paths below remoteDir into localDir over a single ssh channel.
+func (s *ScpCommander) tarDownloadFilesCommand(remoteDir string, paths []string, localDir string) []string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+	remote := fmt.Sprintf("cd %s && tar -czf - -- %s", shellQuote(remoteDir), strings.Join(quoted, " "))
+	return append([]string{"bash", "-c", tarDownloadScript, "tar-download", localDir}, s.sshStream(streamDownload, remote)...)
+}
+
+// Parse 'sha256sum' output into a map of relative paths to checksums.
+func parseManifest(out string) map[string]string {
+	manifest := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		hash, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		manifest[strings.TrimPrefix(name, "./")] = hash
+	}
+	return manifest
+}
+
+// Returns the summary part of a diff report.
+func diffReport(target string, result *DiffResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changes to %s: %d added, %d modified, %d deleted\n", target, len(result.Added), len(result.Modified), len(result.Deleted))
+	for _, name := range result.Added {
+		fmt.Fprintf(&b, "A %s\n", name)
+	}
+	for _, name := range result.Modified {
+		fmt.Fprintf(&b, "M %s\n", name)
+	}
+	for _, name := range result.Deleted {
+		fmt.Fprintf(&b, "D %s\n", name)
+	}
+	return b.String()
+}
@@ -1,6 +1,9 @@
 package main
 
-import "dagger/examples/internal/dagger"
+import (
+	"context"
+	"dagger/examples/internal/dagger"
+)
 
 type Examples struct{}
 
@@ -8,7 +11,8 @@ func (e *Examples) Scp_CopyToRemote(destination string, key *dagger.Secret, file
 	return dag.Scp().
 		Config(destination).
 		WithIdentityFile(key).
-		FileToRemote(file)
+		FileToRemote(file).
+		Container()
 }
 
 func (e *Examples) Scp_CopyToRemoteWithOption(sshd *dagger.Service, key *dagger.Secret, file *dagger.File, target string) *dagger.Container {
@@ -20,7 +24,8 @@ func (e *Examples) Scp_CopyToRemoteWithOption(sshd *dagger.Service, key *dagger.
 		WithIdentityFile(key).
 		FileToRemote(file, dagger.ScpCommanderFileToRemoteOpts{
 			Target: target,
-		})
+		}).
+		Container()
 }
 
 func (e *Examples) Scp_CopyFromRemote(destination string, key *dagger.Secret, path string) *dagger.File {
@@ -44,12 +49,293 @@ func (e *Examples) Scp_UsePassword(destination string, password string, file *da
 	return dag.Scp().
 		Config(destination).
 		WithPassword(dag.SetSecret("password", password)).
-		FileToRemote(file)
+		FileToRemote(file).
+		Container()
 }
 
 func (e *Examples) Scp_CopyDirectoryToRemote(destination string, key *dagger.Secret, dir *dagger.Directory, target string) *dagger.Container {
 	return dag.Scp().
 		Config(destination).
 		WithIdentityFile(key).
-		DirectoryToRemote(dir, target)
+		DirectoryToRemote(dir, target).
+		Container()
+}
+
+func (e *Examples) Scp_Audit(destination string, key *dagger.Secret, file *dagger.File) *dagger.File {
+	commander := dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		WithAudit()
+
+	return commander.AuditLog(commander.FileToRemote(file).Container())
+}
+
+func (e *Examples) Scp_CopyFromRemoteWithCacheKey(destination string, key *dagger.Secret, path string, version string) *dagger.File {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		WithCachePolicy("key", dagger.ScpCommanderWithCachePolicyOpts{
+			Key: version,
+		}).
+		FileFromRemote(path)
+}
+
+func (e *Examples) Scp_SyncDirectory(ctx context.Context, destination string, key *dagger.Secret, dir *dagger.Directory, target string) ([]string, error) {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		SyncDirectory(dir, target, dagger.ScpCommanderSyncDirectoryOpts{
+			Delete:   true,
+			Excludes: []string{"node_modules"},
+		}).
+		Transferred(ctx)
+}
+
+func (e *Examples) Scp_CopyToRemoteOverSftp(destination string, key *dagger.Secret, file *dagger.File) *dagger.Container {
+	return dag.Scp().
+		Config(destination, dagger.ScpConfigOpts{
+			Protocol: "sftp",
+		}).
+		WithIdentityFile(key).
+		FileToRemote(file).
+		Container()
+}
+
+func (e *Examples) Scp_CopyDirectoryToRemoteWithVerify(destination string, key *dagger.Secret, dir *dagger.Directory, target string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		DirectoryToRemote(dir, target, dagger.ScpCommanderDirectoryToRemoteOpts{
+			Verify: true,
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_CopyLogsFromRemote(destination string, key *dagger.Secret, path string) *dagger.Directory {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		DirectoryFromRemote(path, dagger.ScpCommanderDirectoryFromRemoteOpts{
+			Include: []string{"**/*.log"},
+		})
+}
+
+func (e *Examples) Scp_CopyBinaryToRemote(destination string, key *dagger.Secret, file *dagger.File, target string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		FileToRemote(file, dagger.ScpCommanderFileToRemoteOpts{
+			Target: target,
+			Mode:   "0755",
+			Owner:  "app:app",
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_Release(destination string, key *dagger.Secret, dir *dagger.Directory) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		Release(dir, "/srv/app", dagger.ScpCommanderReleaseOpts{
+			Keep: 3,
+		})
+}
+
+func (e *Examples) Scp_Rollback(destination string, key *dagger.Secret) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		Rollback("/srv/app")
+}
+
+func (e *Examples) Scp_CopyDirectoryContentsToRemote(destination string, key *dagger.Secret, dir *dagger.Directory, target string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		DirectoryToRemote(dir, target, dagger.ScpCommanderDirectoryToRemoteOpts{
+			CopyMode: "contents",
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_CopyFilesFromRemote(destination string, key *dagger.Secret, paths []string) *dagger.Directory {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		FilesFromRemote(paths)
+}
+
+func (e *Examples) Scp_CopyToRemoteThrottled(destination string, key *dagger.Secret, file *dagger.File) *dagger.Container {
+	return dag.Scp().
+		Config(destination, dagger.ScpConfigOpts{
+			Compress:           true,
+			BandwidthLimitKbps: 8192,
+		}).
+		WithIdentityFile(key).
+		FileToRemote(file).
+		Container()
+}
+
+func (e *Examples) Scp_GlobFromRemote(destination string, key *dagger.Secret, pattern string) *dagger.Directory {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		GlobFromRemote(pattern, dagger.ScpCommanderGlobFromRemoteOpts{
+			PreserveStructure: true,
+		})
+}
+
+func (e *Examples) Scp_ResumableCopyFromRemote(destination string, key *dagger.Secret, path string, sha256 string) *dagger.File {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		ResumableFileFromRemote(path, dagger.ScpCommanderResumableFileFromRemoteOpts{
+			Retries: 10,
+			Sha256:  sha256,
+		})
+}
+
+func (e *Examples) Scp_CopyBetweenRemotes(source string, sourceKey *dagger.Secret, target string, targetKey *dagger.Secret, path string, targetPath string) *dagger.Container {
+	return dag.Scp().
+		Config(source).
+		WithIdentityFile(sourceKey).
+		CopyTo(dag.Scp().Config(target).WithIdentityFile(targetKey), path, targetPath)
+}
+
+func (e *Examples) Scp_CopyDirectoryToRemoteAsTar(destination string, key *dagger.Secret, dir *dagger.Directory, target string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		DirectoryToRemote(dir, target, dagger.ScpCommanderDirectoryToRemoteOpts{
+			Tar: true,
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_DiffDirectoryWithRemote(destination string, key *dagger.Secret, dir *dagger.Directory, target string) *dagger.File {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		Diff(dir, target, dagger.ScpCommanderDiffOpts{
+			Unified: true,
+		}).
+		Report()
+}
+
+func (e *Examples) Scp_CopyToRemoteWithBackup(destination string, key *dagger.Secret, file *dagger.File, target string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		FileToRemote(file, dagger.ScpCommanderFileToRemoteOpts{
+			Target:    target,
+			Backup:    true,
+			BackupDir: "/var/backups/deploy",
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_RestoreBackup(destination string, key *dagger.Secret, path string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		RestoreBackup(path, dagger.ScpCommanderRestoreBackupOpts{
+			BackupDir: "/var/backups/deploy",
+		})
+}
+
+func (e *Examples) Scp_BackupAndRestore(ctx context.Context, destination string, key *dagger.Secret, file *dagger.File) (*dagger.Container, error) {
+	scp := dag.Scp().
+		Config(destination).
+		WithIdentityFile(key)
+
+	name, err := file.Name(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The file is uploaded into the home directory, and its backup restored by its path relative to it.
+	_, err = scp.
+		FileToRemote(file, dagger.ScpCommanderFileToRemoteOpts{
+			Backup:    true,
+			BackupDir: "/var/backups/deploy",
+		}).
+		Container().
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scp.RestoreBackup(name, dagger.ScpCommanderRestoreBackupOpts{
+		BackupDir: "/var/backups/deploy",
+	}), nil
+}
+
+func (e *Examples) Scp_TemplateToRemote(destination string, key *dagger.Secret, template *dagger.File, secrets *dagger.Secret) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		TemplateToRemote(template, "/etc/app/application.properties", dagger.ScpCommanderTemplateToRemoteOpts{
+			Values:  `{"env": "production", "port": 8080}`,
+			Secrets: secrets,
+			Owner:   "app:app",
+		})
+}
+
+func (e *Examples) Scp_CopyContainerPathToRemote(destination string, key *dagger.Secret, target string) *dagger.Container {
+	build := dag.Container().
+		From("node:20-alpine").
+		WithExec([]string{"sh", "-c", "mkdir -p /app/dist && echo hello > /app/dist/index.html"})
+
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		ContainerPathToRemote(build, "/app/dist", dagger.ScpCommanderContainerPathToRemoteOpts{
+			Target:   target,
+			CopyMode: "contents",
+		}).
+		Container()
+}
+
+func (e *Examples) Scp_CopyRemotePathToContainer(destination string, key *dagger.Secret, path string) *dagger.Container {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		RemotePathToContainer(path, dag.Container().From("alpine:3"), "/data", dagger.ScpCommanderRemotePathToContainerOpts{
+			Directory: true,
+		})
+}
+
+func (e *Examples) Scp_CopyDirectoryToRemoteWithResult(ctx context.Context, destination string, key *dagger.Secret, dir *dagger.Directory, target string) ([]string, error) {
+	return dag.Scp().
+		Config(destination).
+		WithIdentityFile(key).
+		DirectoryToRemote(dir, target, dagger.ScpCommanderDirectoryToRemoteOpts{
+			CopyMode: "contents",
+		}).
+		Paths(ctx)
+}
+
+func (e *Examples) Scp_UseCertificate(destination string, key *dagger.Secret, certificate *dagger.File, file *dagger.File) *dagger.Container {
+	credential := dag.SSHCredential().
+		WithKey(key).
+		WithCertificate(certificate)
+
+	return dag.Scp().
+		Config(destination).
+		WithCredential(credential).
+		FileToRemote(file).
+		Container()
+}
+
+func (e *Examples) Scp_UseKeyring(appKey *dagger.Secret, artifactKey *dagger.Secret, file *dagger.File) *dagger.Container {
+	keyring := dag.SSHCredential().
+		Keyring().
+		WithIdentity("app", dag.SSHCredential().WithKey(appKey), dagger.SSHCredentialKeyringWithIdentityOpts{
+			Hosts: []string{"*.app.example.com"},
+		}).
+		WithIdentity("artifacts", dag.SSHCredential().WithKey(artifactKey))
+
+	return dag.Scp().
+		Config("deploy@web1.app.example.com").
+		WithKeyring(keyring).
+		FileToRemote(file).
+		Container()
 }
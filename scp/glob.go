@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+// Remote script that expands "$pattern" relative to "$base" and writes the matches to stdout as a tar archive.
+// The pattern is inserted unquoted by remoteGlobScript so that the remote shell expands it.
+const remoteGlobScript = `
+cd "$base" || exit 1
+set -- %s
+n=$#
+for f in "$@"; do
+	if [ -e "$f" ] || [ -L "$f" ]; then set -- "$@" "$f"; fi
+done
+shift $n
+if [ $# -eq 0 ]; then
+	echo "no files match $base/$pattern" >&2
+	exit 1
+fi
+tar -cf - "$@"
+`
+
+// Local shell script that extracts the tar archive written by "$@" into "$GLOB_DIR",
+// and moves every file to the top level of "$GLOB_FLAT_DIR" unless it is empty.
+const globScript = `
+set -o pipefail
+mkdir -p "$GLOB_DIR"
+"$@" | tar -xf - -C "$GLOB_DIR" || exit 1
+[ -n "$GLOB_FLAT_DIR" ] || exit 0
+duplicates=$(find "$GLOB_DIR" -type f -printf '%f\n' | sort | uniq -d)
+if [ -n "$duplicates" ]; then
+	echo "matched files with the same name, preserve the directory structure to download them:" >&2
+	echo "$duplicates" | sed 's/^/  /' >&2
+	exit 1
+fi
+mkdir -p "$GLOB_FLAT_DIR"
+find "$GLOB_DIR" -type f -exec mv -t "$GLOB_FLAT_DIR" {} +
+`
+
+// Copy the files matching a glob pattern from a remote server.
+// Matches are returned in a directory, either by base name or at their path relative to the pattern's
+// leading directory (e.g. '/var/log/app' for '/var/log/app/*/*.log.gz').
+//
+// Note: Requires a shell and tar on the remote server.
+func (s *ScpCommander) GlobFromRemote(
+	ctx context.Context,
+	// glob pattern on the remote server (e.g. /var/log/app/*.log.gz)
+	pattern string,
+	// keep the directory structure below the leading directory of the pattern
+	// +optional
+	preserveStructure bool,
+) (*dagger.Directory, error) {
+	base, rel := splitGlob(pattern)
+	if rel == "" {
+		return nil, fmt.Errorf("pattern %q has no glob", pattern)
+	}
+
+	globDir := "/glob-dir"
+	flatDir := ""
+	targetPath := globDir
+	if !preserveStructure {
+		flatDir = "/glob-flat-dir"
+		targetPath = flatDir
+	}
+
+	remote := fmt.Sprintf("base=%s\npattern=%s\n", shellQuote(base), shellQuote(rel)) +
+		fmt.Sprintf(remoteGlobScript, globQuote(rel))
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithEnvVariable("GLOB_DIR", globDir).
+		WithEnvVariable("GLOB_FLAT_DIR", flatDir)
+
+	ctr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "download",
+		Source:   pattern,
+		Target:   targetPath,
+	}, targetPath, append([]string{"bash", "-c", globScript, "glob"}, s.sshStream(streamDownload, remote)...))
+	if err != nil {
+		return nil, err
+	}
+
+	return ctr.Directory(targetPath), nil
+}
+
+// Split a glob pattern into its leading directory without glob characters and the rest.
+func splitGlob(pattern string) (string, string) {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[") {
+			base := strings.Join(segments[:i], "/")
+			if base == "" {
+				base = "."
+				if strings.HasPrefix(pattern, "/") {
+					base = "/"
+				}
+			}
+			return base, strings.Join(segments[i:], "/")
+		}
+	}
+	return pattern, ""
+}
+
+// Escape every character of a glob pattern for a POSIX shell except the glob characters.
+func globQuote(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch {
+		case strings.ContainsRune("*?[]!", r),
+			r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			strings.ContainsRune("/._-", r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
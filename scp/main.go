@@ -1,15 +1,15 @@
 // Copy to/from remote server using SCP
 //
-// Performs copying of files and directories to and from a remote server over SCP using password or IdentityFile.
+// Performs copying of files and directories to and from a remote server over SCP (or rsync for directory sync) using password or IdentityFile.
 package main
 
 import (
 	"context"
 	"dagger/scp/internal/dagger"
-	"errors"
+	"fmt"
 	"path"
 	"strconv"
-	"time"
+	"strings"
 )
 
 // SCP dagger module
@@ -30,7 +30,7 @@ func (s *Scp) BaseContainer() *dagger.Container {
 	return dag.Container().
 		From("ubuntu:22.04").
 		WithExec([]string{"apt", "update"}).
-		WithExec([]string{"apt", "install", "-y", "openssh-client", "sshpass"})
+		WithExec([]string{"apt", "install", "-y", "openssh-client", "sshpass", "rsync", "pv"})
 }
 
 // Set configuration for SCP connections.
@@ -45,16 +45,32 @@ func (s *Scp) Config(
 	// base container
 	// +optional
 	baseCtr *dagger.Container,
-) *ScpConfig {
+	// transfer protocol: scp, or sftp for servers with the legacy scp protocol disabled
+	// +optional
+	// +default="scp"
+	protocol string,
+	// compress transfers
+	// +optional
+	compress bool,
+	// bandwidth limit in Kbit/s (0 is unlimited, see WithBandwidthLimit)
+	// +optional
+	bandwidthLimitKbps int,
+) (*ScpConfig, error) {
+	if bandwidthLimitKbps < 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit %d", bandwidthLimitKbps)
+	}
 	if baseCtr == nil {
 		baseCtr = s.BaseContainer()
 	}
 
 	return &ScpConfig{
-		Destination: destination,
-		Port:        port,
-		BaseCtr:     baseCtr,
-	}
+		Destination:        destination,
+		Port:               port,
+		BaseCtr:            baseCtr,
+		Protocol:           protocol,
+		Compress:           compress,
+		BandwidthLimitKbps: bandwidthLimitKbps,
+	}, nil
 }
 
 // SCP configuration
@@ -65,6 +81,12 @@ type ScpConfig struct {
 	Port int
 	// +private
 	BaseCtr *dagger.Container
+	// +private
+	Protocol string
+	// +private
+	Compress bool
+	// +private
+	BandwidthLimitKbps int
 }
 
 // Set the password as the SCP connection credentials.
@@ -73,55 +95,139 @@ func (s *ScpConfig) WithPassword(
 	// password
 	arg *dagger.Secret,
 ) (*ScpCommander, error) {
-	passwordText, err := arg.Plaintext(ctx)
-	if err != nil {
-		return nil, errors.New("invalid password secret")
-	}
-
-	return &ScpCommander{
-		Destination: s.Destination,
-		BaseCtr:     s.BaseCtr,
-		ScpBaseCommand: []string{
-			"sshpass",
-			"-p", passwordText,
-			"scp",
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "LogLevel=error",
-			"-P", strconv.Itoa(s.Port),
-		},
-	}, nil
+	return s.WithCredential(ctx, dag.SSHCredential().WithPassword(arg))
 }
 
 // Set up identity file with SCP connection credentials.
 //
 // Note: Tested against RSA-formatted and OPENSSH-formatted private keys.
 func (s *ScpConfig) WithIdentityFile(
+	ctx context.Context,
 	// identity file
 	arg *dagger.Secret,
 ) (*ScpCommander, error) {
-	keyPath := "/identity_key"
+	return s.WithCredential(ctx, dag.SSHCredential().WithKey(arg))
+}
+
+// Set the SCP connection credentials.
+func (s *ScpConfig) WithCredential(
+	ctx context.Context,
+	// credentials created with the ssh-credential module
+	credential *dagger.SSHCredential,
+) (*ScpCommander, error) {
+	return s.withIdentity(ctx, credential.Identity(s.Destination))
+}
+
+// Set the SCP connection credentials to the identity of the keyring that matches the destination host.
+func (s *ScpConfig) WithKeyring(
+	ctx context.Context,
+	// keyring created with the ssh-credential module
+	keyring *dagger.SSHCredentialKeyring,
+) (*ScpCommander, error) {
+	return s.withIdentity(ctx, keyring.Identity(s.Destination))
+}
+
+// Returns a commander that connects with the credential of the identity, mounting its files at the path of the identity.
+func (s *ScpConfig) withIdentity(ctx context.Context, identity *dagger.SSHCredentialIdentity) (*ScpCommander, error) {
+	mountPath, err := identity.Path(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credential := identity.Credential()
+
+	protocolOptions, err := scpProtocolOptions(s.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	scpCommand, err := authCommand(ctx, credential, mountPath, "scp", "-P", s.Port)
+	if err != nil {
+		return nil, err
+	}
+	sshCommand, err := authCommand(ctx, credential, mountPath, "ssh", "-p", s.Port)
+	if err != nil {
+		return nil, err
+	}
+	sftpCommand, err := authCommand(ctx, credential, mountPath, "sftp", "-P", s.Port)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := credentialSecrets(ctx, credential)
+	if err != nil {
+		return nil, err
+	}
 
 	return &ScpCommander{
-		Destination: s.Destination,
-		BaseCtr:     s.BaseCtr.WithMountedSecret(keyPath, arg),
-		ScpBaseCommand: []string{
-			"scp",
-			"-i", keyPath,
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "LogLevel=error",
-			"-P", strconv.Itoa(s.Port),
-		},
+		Destination:        s.Destination,
+		Port:               s.Port,
+		BaseCtr:            credential.Mount(s.BaseCtr, mountPath),
+		Credential:         credential,
+		IdentityPath:       mountPath,
+		Secrets:            secrets,
+		Protocol:           s.Protocol,
+		Compress:           s.Compress,
+		BandwidthLimitKbps: s.BandwidthLimitKbps,
+		ScpBaseCommand:     append(scpCommand, protocolOptions...),
+		SshBaseCommand:     sshCommand,
+		// sftp -b disables password prompts unless BatchMode is already set, which sshpass relies on
+		SftpBaseCommand: append(sftpCommand, "-o", "BatchMode=no"),
 	}, nil
 }
 
+// Returns the command that runs program with the credential mounted at mountPath and the port option.
+func authCommand(ctx context.Context, credential *dagger.SSHCredential, mountPath string, program string, portOption string, port int) ([]string, error) {
+	cmd, err := credential.Command(ctx, program, mountPath)
+	if err != nil {
+		return nil, err
+	}
+	return append(cmd, "-o", "LogLevel=error", portOption, strconv.Itoa(port)), nil
+}
+
+// Returns the secrets of the credential to redact from the audit transcript.
+func credentialSecrets(ctx context.Context, credential *dagger.SSHCredential) ([]*dagger.Secret, error) {
+	list, err := credential.Secrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*dagger.Secret, len(list))
+	for i := range list {
+		secrets[i] = &list[i]
+	}
+	return secrets, nil
+}
+
 // SCP command launcher
 type ScpCommander struct {
 	// +private
 	Destination string
 	// +private
+	Port int
+	// +private
 	BaseCtr *dagger.Container
 	// +private
+	Credential *dagger.SSHCredential
+	// +private
+	IdentityPath string
+	// +private
 	ScpBaseCommand []string
+	// +private
+	SshBaseCommand []string
+	// +private
+	SftpBaseCommand []string
+	// +private
+	Protocol string
+	// +private
+	Compress bool
+	// +private
+	BandwidthLimitKbps int
+	// +private
+	Secrets []*dagger.Secret
+	// +private
+	Audit bool
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
 }
 
 // Returns a container that is ready to launch SCP command.
@@ -129,7 +235,80 @@ func (s *ScpCommander) Container() *dagger.Container {
 	return s.BaseCtr
 }
 
+// Set the cache policy for transfers run afterwards.
+// By default every transfer runs again on each call.
+// Use the "key" policy to reuse results while the key (e.g. a version string or a checksum) stays the same,
+// or the "forever" policy to run an idempotent transfer only once.
+func (s *ScpCommander) WithCachePolicy(
+	// cache policy: always, key or forever
+	policy string,
+	// cache key, required by the "key" policy
+	// +optional
+	key string,
+) (*ScpCommander, error) {
+	if err := validateCachePolicy(policy, key); err != nil {
+		return nil, err
+	}
+
+	s.CachePolicy = policy
+	s.CacheKey = key
+	return s, nil
+}
+
+// Set whether transfers run afterwards are compressed.
+func (s *ScpCommander) WithCompression(
+	// compress transfers
+	enabled bool,
+) *ScpCommander {
+	s.Compress = enabled
+	return s
+}
+
+// Set the bandwidth limit for transfers run afterwards.
+// Tar streams (the tar transfer mode, FilesFromRemote, GlobFromRemote and CopyTo) are limited with pv,
+// which a custom base container must provide.
+func (s *ScpCommander) WithBandwidthLimit(
+	// bandwidth limit in Kbit/s (0 is unlimited)
+	kbps int,
+) (*ScpCommander, error) {
+	if kbps < 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit %d", kbps)
+	}
+
+	s.BandwidthLimitKbps = kbps
+	return s, nil
+}
+
+// Enable audit mode.
+// Every transfer run afterwards is appended as a JSON line to a transcript inside the returned container,
+// with the destination, direction, source and target paths, timestamps, exit code and transferred bytes.
+// Values of the credential secret and of the given secrets are redacted from the transcript.
+//
+// To keep a single transcript across several transfers, pass the returned container as the base container of the next Config.
+//
+// Note: A failing transfer is recorded with its exit code, and the error returned for it contains its audit record and stderr,
+// since no container is returned to read the transcript from.
+func (s *ScpCommander) WithAudit(
+	// additional secrets to redact from the transcript
+	// +optional
+	redact []*dagger.Secret,
+) *ScpCommander {
+	s.Audit = true
+	s.Secrets = append(s.Secrets, redact...)
+	return s
+}
+
+// Returns the audit transcript from a container returned in audit mode.
+func (s *ScpCommander) AuditLog(
+	// container returned by a transfer run in audit mode
+	ctr *dagger.Container,
+) *dagger.File {
+	return ctr.File(AuditLogPath)
+}
+
 // Copy a file to a remote server.
+//
+// Returns the transfer statistics and the remote path of the file, which is resolved by a shell on the remote server if available.
 func (s *ScpCommander) FileToRemote(
 	ctx context.Context,
 	// source file
@@ -138,60 +317,367 @@ func (s *ScpCommander) FileToRemote(
 	// (If not entered, '.' is used as the default)
 	// +optional
 	target string,
-) (*dagger.Container, error) {
+	// verify the SHA-256 checksum of the uploaded file
+	// +optional
+	verify bool,
+	// preserve the modification time and mode of the source file (scp -p)
+	// +optional
+	preserve bool,
+	// mode to set on the uploaded file in octal (e.g. 0755)
+	// +optional
+	mode string,
+	// owner to set on the uploaded file as user or user:group (uses sudo unless connected as root)
+	// +optional
+	owner string,
+	// back up the existing remote file before it is overwritten (see RestoreBackup)
+	// +optional
+	backup bool,
+	// directory on the remote server to archive the backup in as '[name].[checksum].[timestamp].tar.gz'
+	// (If not entered, the backup is copied next to the file as '[name].[timestamp]')
+	// +optional
+	backupDir string,
+) (*TransferResult, error) {
 	if target == "" {
 		target = "."
 	}
+	if err := validateMode(mode); err != nil {
+		return nil, err
+	}
 
 	name, err := source.Name(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.BaseCtr.
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
-		WithFile(name, source).
-		WithExec(append(s.ScpBaseCommand, name, s.Destination+":"+target)), nil
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithFile(name, source)
+	if backup {
+		ctr, err = s.backup(ctx, ctr, target, name, backupDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctr, err = s.exec(ctx, ctr, auditEntry{
+		Transfer: "upload",
+		Source:   name,
+		Target:   target,
+	}, name, transferStats(name, append(s.scpCommand(preserve), name, s.Destination+":"+target)))
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err = s.setFileAttributes(ctx, ctr, name, target, mode, owner)
+	if err != nil {
+		return nil, err
+	}
+	if verify {
+		ctr, err = s.verifyFile(ctx, ctr, name, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fallback := target
+	if target == "." || strings.HasSuffix(target, "/") {
+		fallback = path.Join(target, name)
+	}
+	return s.transferResult(ctx, ctr, uploadedFileScript(target, name, `echo "$f"`), fallback, false)
 }
 
 // Copy a file from a remote server.
 func (s *ScpCommander) FileFromRemote(
+	ctx context.Context,
 	// source path
 	source string,
-) *dagger.File {
+	// expected SHA-256 digest of the file, verified after the download
+	// +optional
+	sha256 string,
+) (*dagger.File, error) {
 	_, file := path.Split(source)
 
-	return s.BaseCtr.
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
-		WithExec(append(s.ScpBaseCommand, s.Destination+":"+source, file)).
-		File(file)
+	ctr, err := s.exec(ctx, s.BaseCtr.With(withCachePolicy(s.CachePolicy, s.CacheKey)), auditEntry{
+		Transfer: "download",
+		Source:   source,
+		Target:   file,
+	}, file, append(s.scpCommand(false), s.Destination+":"+source, file))
+	if err != nil {
+		return nil, err
+	}
+
+	if sha256 != "" {
+		digest, err := parseSha256(sha256)
+		if err != nil {
+			return nil, err
+		}
+		ctr = ctr.WithExec([]string{"bash", "-c", checkDigestScript, "verify", file, digest})
+	}
+
+	return ctr.File(file), nil
 }
 
 // Copy a directory to a remote server.
+//
+// With a copy mode, the target is created if needed, over sftp so that this also works with SFTP-only accounts,
+// and the result does not depend on whether it already existed.
+// Without one, 'scp -r' decides: the directory is copied to the target path, or into '[target]/source-dir' if the target already exists.
+//
+// The tar transfer mode streams a compressed tar archive over a single ssh channel, which is much faster for many small files
+// and keeps symlinks and permissions. It extracts into the target unless the subdirectory copy mode is used,
+// and requires a shell and tar on the remote server.
+//
+// Returns the transfer statistics and the remote paths of the files.
 func (s *ScpCommander) DirectoryToRemote(
+	ctx context.Context,
 	// source directory
 	source *dagger.Directory,
 	// destination path
-	// (If the path is an already existing directory, it will be copied to the '[path]/source-dir' location)
+	// (Without a copy mode, if the path is an already existing directory, it will be copied to the '[path]/source-dir' location)
 	target string,
-) (*dagger.Container, error) {
+	// verify the SHA-256 checksums of the uploaded files
+	// +optional
+	verify bool,
+	// glob patterns of the files to copy (e.g. **/*.html)
+	// +optional
+	include []string,
+	// glob patterns of the files to skip (e.g. **/node_modules)
+	// +optional
+	exclude []string,
+	// preserve the modification times and modes of the source files (scp -p)
+	// +optional
+	preserve bool,
+	// mode to set on the uploaded files in octal (e.g. 0755); directories and files already in the target are left unchanged
+	// +optional
+	mode string,
+	// owner to set on the uploaded paths as user or user:group (uses sudo unless connected as root); files already in the target are left unchanged
+	// +optional
+	owner string,
+	// copy mode: contents (into the target) or subdirectory (into '[target]/[name]')
+	// +optional
+	copyMode string,
+	// subdirectory name for the subdirectory copy mode
+	// +optional
+	name string,
+	// transfer a compressed tar stream instead of using 'scp -r'
+	// +optional
+	tar bool,
+	// back up the existing remote directory before it is written (see RestoreBackup)
+	// +optional
+	backup bool,
+	// directory on the remote server to archive the backup in as '[name].[checksum].[timestamp].tar.gz'
+	// (If not entered, the backup is copied next to the directory as '[name].[timestamp]')
+	// +optional
+	backupDir string,
+) (*TransferResult, error) {
+	if err := validateMode(mode); err != nil {
+		return nil, err
+	}
+	if err := validateCopyMode(copyMode, name); err != nil {
+		return nil, err
+	}
+
 	sourcePath := "/source-dir"
+	if copyMode == CopySubdirectory {
+		sourcePath = path.Join("/upload", name)
+	}
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithDirectory(sourcePath, source, dagger.ContainerWithDirectoryOpts{
+			Include: include,
+			Exclude: exclude,
+		})
+
+	scp := s.scpCommand(preserve)
+	dest := s.Destination + ":" + target
+	base := target
+	if copyMode == CopySubdirectory {
+		base = path.Join(target, name)
+	}
+	var err error
+	if backup {
+		ctr, err = s.backup(ctx, ctr, base, "", backupDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var args []string
+	switch {
+	case tar:
+		args = s.tarUploadCommand(sourcePath, base)
+	case copyMode == CopyContents:
+		args = append([]string{"bash", "-c", copyContentsScript, "copy", sourcePath, dest}, scp...)
+	default:
+		// A subdirectory copy differs only in the source path, which is named after the subdirectory.
+		args = append(scp, "-r", sourcePath, dest)
+	}
+
+	if copyMode != "" && !tar {
+		ctr, err = s.mkdir(ctx, ctr, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctr, err = s.exec(ctx, ctr, auditEntry{
+		Transfer: "upload",
+		Source:   sourcePath,
+		Target:   target,
+	}, sourcePath, transferStats(sourcePath, args))
+	if err != nil {
+		return nil, err
+	}
+
+	nested := false
+	if copyMode == "" && !tar {
+		// The source itself may contain an entry named like the uploaded directory,
+		// in which case it cannot be told apart from a copy nested into an existing target.
+		ambiguous, err := containsEntry(ctx, source, path.Base(sourcePath))
+		if err != nil {
+			return nil, err
+		}
+		nested = !ambiguous
+	}
 
-	return s.BaseCtr.
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
-		WithDirectory(sourcePath, source).
-		WithExec(append(s.ScpBaseCommand, "-r", sourcePath, s.Destination+":"+target)), nil
+	// The uploaded directory itself is only changed when the upload created it, not when its contents were copied into the target.
+	root := copyMode == CopySubdirectory || (copyMode == "" && !tar)
+	ctr, err = s.setDirectoryAttributes(ctx, ctr, sourcePath, path.Base(sourcePath), base, nested, root, mode, owner)
+	if err != nil {
+		return nil, err
+	}
+	if verify {
+		ctr, err = s.verifyDirectory(ctx, ctr, sourcePath, base, nested)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolve := ""
+	if copyMode == "" && !tar {
+		resolve = uploadedDirectoryScript(base, path.Base(sourcePath), nested, `echo "$base"`)
+	}
+	return s.transferResult(ctx, ctr, resolve, base, true)
 }
 
 // Copy a directory from a remote server.
+//
+// The tar transfer mode streams a compressed tar archive over a single ssh channel, which is much faster for many small files
+// and keeps symlinks and permissions. It requires a shell and tar on the remote server.
+//
+// With include or exclude patterns, only the matching files are transferred, using rsync, which is then required on the remote server.
+// In the tar transfer mode only the exclude patterns reduce the transfer; the include patterns are applied after the download.
 func (s *ScpCommander) DirectoryFromRemote(
+	ctx context.Context,
 	// source path
 	source string,
-) *dagger.Directory {
+	// glob patterns of the files to keep (e.g. **/*.log)
+	// +optional
+	include []string,
+	// glob patterns of the files to drop (e.g. **/node_modules)
+	// +optional
+	exclude []string,
+	// transfer a compressed tar stream instead of using 'scp -r'
+	// +optional
+	tar bool,
+) (*dagger.Directory, error) {
 	targetPath := "/target-dir"
 
-	return s.BaseCtr.
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
-		WithExec(append(s.ScpBaseCommand, "-r", s.Destination+":"+source, targetPath)).
-		Directory(targetPath)
+	var args []string
+	switch {
+	case tar:
+		args = s.tarDownloadCommand(source, targetPath, exclude)
+	case len(include) > 0 || len(exclude) > 0:
+		args = append(s.rsyncCommand(), "--archive")
+		args = append(args, rsyncFilters(include, exclude)...)
+		args = append(args, s.Destination+":"+strings.TrimSuffix(source, "/")+"/", targetPath+"/")
+	default:
+		args = append(s.scpCommand(false), "-r", s.Destination+":"+source, targetPath)
+	}
+
+	ctr, err := s.exec(ctx, s.BaseCtr.With(withCachePolicy(s.CachePolicy, s.CacheKey)), auditEntry{
+		Transfer: "download",
+		Source:   source,
+		Target:   targetPath,
+	}, targetPath, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterDirectory(ctr.Directory(targetPath), include, exclude), nil
+}
+
+// Run the scp command in ctr, recording it in the audit transcript when audit mode is enabled.
+func (s *ScpCommander) exec(
+	ctx context.Context,
+	ctr *dagger.Container,
+	entry auditEntry,
+	localPath string,
+	args []string,
+) (*dagger.Container, error) {
+	if !s.Audit {
+		return ctr.WithExec(args), nil
+	}
+
+	entry.Destination = s.Destination
+	if err := redact(ctx, s.Secrets, &entry.Source, &entry.Target); err != nil {
+		return nil, err
+	}
+
+	return auditExec(ctx, ctr, entry, localPath, args)
+}
+
+// Returns the scp command with the transfer options, preserving modification times and modes if requested.
+func (s *ScpCommander) scpCommand(preserve bool) []string {
+	cmd := append([]string{}, s.ScpBaseCommand...)
+	if s.Compress {
+		cmd = append(cmd, "-C")
+	}
+	if s.BandwidthLimitKbps > 0 {
+		cmd = append(cmd, "-l", strconv.Itoa(s.BandwidthLimitKbps))
+	}
+	if preserve {
+		cmd = append(cmd, "-p")
+	}
+	return cmd
+}
+
+// Returns the command that runs script on the remote server over ssh.
+func (s *ScpCommander) sshExec(script string) []string {
+	return append(append([]string{}, s.SshBaseCommand...), s.Destination, script)
+}
+
+// Quote s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// Returns the variants of a glob pattern relative to the root, with and without each '**/' segment,
+// for matchers in which '**/' does not match zero directories.
+func globVariants(pattern string) []string {
+	variants := []string{""}
+	for _, part := range strings.SplitAfter(strings.TrimPrefix(pattern, "/"), "/") {
+		next := make([]string, 0, len(variants))
+		for _, variant := range variants {
+			next = append(next, variant+part)
+			if part == "**/" {
+				next = append(next, variant)
+			}
+		}
+		variants = next
+	}
+	return variants
+}
+
+// Returns dir filtered by the include and exclude glob patterns, the same way uploads are filtered.
+func filterDirectory(dir *dagger.Directory, include []string, exclude []string) *dagger.Directory {
+	if len(include) == 0 && len(exclude) == 0 {
+		return dir
+	}
+
+	return dag.Directory().WithDirectory("/", dir, dagger.DirectoryWithDirectoryOpts{
+		Include: include,
+		Exclude: exclude,
+	})
 }
@@ -0,0 +1,25 @@
+package main
+
+import "fmt"
+
+// Transfer protocols
+const (
+	// Legacy SCP protocol (default)
+	ProtocolScp = "scp"
+	// SFTP protocol, which also works with SFTP-only and chroot'ed accounts without a shell
+	ProtocolSftp = "sftp"
+)
+
+// Returns the scp options that select the transfer protocol.
+//
+// Note: SFTP transfers use 'scp -s', which requires OpenSSH 8.7 or later in the base container.
+func scpProtocolOptions(protocol string) ([]string, error) {
+	switch protocol {
+	case "", ProtocolScp:
+		return nil, nil
+	case ProtocolSftp:
+		return []string{"-s"}, nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %q (expected %q or %q)", protocol, ProtocolScp, ProtocolSftp)
+	}
+}
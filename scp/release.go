@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Remote script that prepares "$d/releases" for the new release "$release".
+const prepareReleaseScript = `
+mkdir -p "$d/releases" || exit 1
+if [ -e "$d/releases/$release" ]; then
+	echo "release $release already exists in $d/releases" >&2
+	exit 1
+fi
+`
+
+// Remote script that atomically points "$d/current" to "releases/$release"
+// and removes all but the newest "$keep" releases, never the current one.
+const switchReleaseScript = `
+cd "$d" || exit 1
+ln -sfn "releases/$release" .current.tmp && mv -Tf .current.tmp current || exit 1
+if [ "$keep" -gt 0 ]; then
+	ls -1 releases | sort -r | tail -n +$((keep + 1)) | while read -r old; do
+		[ "$old" = "$release" ] || rm -rf "releases/$old"
+	done
+fi
+echo "current -> releases/$release"
+`
+
+// Remote script that points "$d/current" back to the release before the current one.
+const rollbackScript = `
+cd "$d" || exit 1
+current=$(basename "$(readlink current)")
+previous=$(ls -1 releases | sort | awk -v cur="$current" '$0 < cur { prev = $0 } END { print prev }')
+if [ -z "$previous" ]; then
+	echo "no release before $current in $d/releases" >&2
+	exit 1
+fi
+ln -sfn "releases/$previous" .current.tmp && mv -Tf .current.tmp current || exit 1
+echo "current -> releases/$previous"
+`
+
+// Deploy a directory as a new release.
+// The directory is uploaded to '[deployPath]/releases/[timestamp]', then '[deployPath]/current' is atomically switched to it,
+// so the live path never points to a partially copied tree.
+// Only the newest releases are kept.
+//
+// Note: Requires a shell with GNU-compatible 'mv -T' on the remote server.
+func (s *ScpCommander) Release(
+	ctx context.Context,
+	// release directory
+	source *dagger.Directory,
+	// deploy path on the remote server that holds 'releases' and 'current'
+	deployPath string,
+	// number of releases to keep (0 keeps all)
+	// +optional
+	// +default=5
+	keep int,
+	// verify the SHA-256 checksums of the uploaded files before switching
+	// +optional
+	verify bool,
+) (*dagger.Container, error) {
+	if keep < 0 {
+		return nil, fmt.Errorf("invalid number of releases to keep %d", keep)
+	}
+
+	sourcePath := "/source-dir"
+	release := time.Now().UTC().Format("20060102150405")
+	target := releasePath(deployPath, release)
+	vars := fmt.Sprintf("d=%s\nrelease=%s\nkeep=%d\n", shellQuote(deployPath), shellQuote(release), keep)
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithDirectory(sourcePath, source)
+
+	ctr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "release-prepare",
+		Target:   target,
+	}, "", s.sshExec(vars+prepareReleaseScript))
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err = s.exec(ctx, ctr, auditEntry{
+		Transfer: "release",
+		Source:   sourcePath,
+		Target:   target,
+	}, sourcePath, append(s.scpCommand(false), "-r", sourcePath, s.Destination+":"+target))
+	if err != nil {
+		return nil, err
+	}
+
+	if verify {
+		ctr, err = s.verifyDirectory(ctx, ctr, sourcePath, target, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "release-switch",
+		Source:   target,
+		Target:   path.Join(deployPath, "current"),
+	}, "", s.sshExec(vars+switchReleaseScript))
+}
+
+// Switch '[deployPath]/current' back to the release before the current one.
+func (s *ScpCommander) Rollback(
+	ctx context.Context,
+	// deploy path on the remote server that holds 'releases' and 'current'
+	deployPath string,
+) (*dagger.Container, error) {
+	return s.exec(ctx, s.BaseCtr.With(withCachePolicy(s.CachePolicy, s.CacheKey)), auditEntry{
+		Transfer: "rollback",
+		Target:   path.Join(deployPath, "current"),
+	}, "", s.sshExec(fmt.Sprintf("d=%s\n%s", shellQuote(deployPath), rollbackScript)))
+}
+
+// Returns the remote path of a release below the deploy path.
+func releasePath(deployPath string, release string) string {
+	return path.Join(deployPath, "releases", release)
+}
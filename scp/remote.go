@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// Remote shell snippet that sets "$f" to the remote path of the file "$name" uploaded to "$t".
+// scp copies into '[target]/[name]' when the target is a directory.
+const uploadedFileSnippet = `
+if [ -d "$t" ]; then f="$t/$name"; else f="$t"; fi
+`
+
+// Remote shell snippet that sets "$base" to the remote path of the directory "$name" uploaded to "$t".
+// Unless "$nested" is 0, the directory is "$t/$name" if it exists, since 'scp -r' copies into it when the target already exists.
+const uploadedDirectorySnippet = `
+if [ "$nested" != 0 ] && [ -d "$t/$name" ]; then base="$t/$name"; else base="$t"; fi
+`
+
+// Returns a remote script that runs script with "$f" set to the file name uploaded to target.
+func uploadedFileScript(target string, name string, script string) string {
+	return fmt.Sprintf("t=%s\nname=%s\n%s%s", shellQuote(target), shellQuote(name), uploadedFileSnippet, script)
+}
+
+// Returns a remote script that runs script with "$base" set to the directory name uploaded to target.
+func uploadedDirectoryScript(target string, name string, nested bool, script string) string {
+	nestedFlag := "0"
+	if nested {
+		nestedFlag = "1"
+	}
+	return fmt.Sprintf("t=%s\nname=%s\nnested=%s\n%s%s", shellQuote(target), shellQuote(name), nestedFlag, uploadedDirectorySnippet, script)
+}
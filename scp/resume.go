@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/scp/internal/dagger"
+	"encoding/hex"
+	"fmt"
+	"path"
+)
+
+// Local shell script that runs "$@" until it succeeds, at most "$1" more times after the first attempt,
+// waiting a little longer after each failure.
+// Only rsync's connection and timeout errors (10, 12, 30, 35) and ssh's 255 are retried; any other failure is final.
+const retryScript = `
+retries=$1; shift
+attempt=1
+until "$@"; do
+	code=$?
+	case $code in
+	10|12|30|35|255) ;;
+	*) exit $code ;;
+	esac
+	if [ $attempt -gt $retries ]; then
+		echo "transfer failed after $attempt attempts" >&2
+		exit $code
+	fi
+	echo "transfer interrupted (exit $code), resuming in $((attempt * 5))s" >&2
+	sleep $((attempt * 5))
+	attempt=$((attempt + 1))
+done
+`
+
+// Copy a large file from a remote server, resuming after interruptions.
+// rsync keeps the partial file and continues from its end, verifying the whole file once complete.
+// The partial file is kept in a cache volume, so a later call also resumes a download that failed every attempt.
+//
+// Note: Requires rsync on the remote server.
+func (s *ScpCommander) ResumableFileFromRemote(
+	ctx context.Context,
+	// source path
+	source string,
+	// number of retries after an interrupted transfer
+	// +optional
+	// +default=5
+	retries int,
+	// expected SHA-256 digest of the file, verified after the download
+	// +optional
+	sha256 string,
+) (*dagger.File, error) {
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid number of retries %d", retries)
+	}
+
+	resumePath := "/resume"
+	downloadPath := "/download"
+	_, file := path.Split(source)
+	partial := path.Join(resumePath, file)
+	download := path.Join(downloadPath, file)
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithMountedCache(resumePath, dag.CacheVolume(resumeCacheKey(s.Destination, source)), dagger.ContainerWithMountedCacheOpts{
+			Sharing: dagger.Locked,
+		})
+
+	args := append(s.rsyncCommand(), "--partial", "--append-verify", s.Destination+":"+source, partial)
+	ctr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "download",
+		Source:   source,
+		Target:   file,
+	}, partial, append([]string{"bash", "-c", retryScript, "retry", fmt.Sprint(retries)}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache volumes are not part of the container filesystem, so move the completed file out of it.
+	ctr = ctr.WithExec([]string{"bash", "-c", `mkdir -p "$(dirname "$2")" && cp "$1" "$2" && rm -f "$1"`, "move", partial, download})
+
+	if sha256 != "" {
+		digest, err := parseSha256(sha256)
+		if err != nil {
+			return nil, err
+		}
+		ctr = ctr.WithExec([]string{"bash", "-c", checkDigestScript, "verify", download, digest})
+	}
+
+	return ctr.File(download), nil
+}
+
+// Copy a large file to a remote server, resuming after interruptions.
+// rsync keeps the partial file on the remote server and continues from its end, verifying the whole file once complete.
+//
+// Note: Requires rsync on the remote server.
+func (s *ScpCommander) ResumableFileToRemote(
+	ctx context.Context,
+	// source file
+	source *dagger.File,
+	// destination path
+	// (If not entered, '.' is used as the default)
+	// +optional
+	target string,
+	// number of retries after an interrupted transfer
+	// +optional
+	// +default=5
+	retries int,
+) (*dagger.Container, error) {
+	if target == "" {
+		target = "."
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid number of retries %d", retries)
+	}
+
+	name, err := source.Name(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithFile(name, source)
+
+	args := append(s.rsyncCommand(), "--partial", "--append-verify", name, s.Destination+":"+target)
+	return s.exec(ctx, ctr, auditEntry{
+		Transfer: "upload",
+		Source:   name,
+		Target:   target,
+	}, name, append([]string{"bash", "-c", retryScript, "retry", fmt.Sprint(retries)}, args...))
+}
+
+// Returns the name of the cache volume that keeps the partial download of source from destination.
+func resumeCacheKey(destination string, source string) string {
+	sum := sha256.Sum256([]byte(destination + ":" + source))
+	return "scp-resume-" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+// Result of a directory sync
+type SyncResult struct {
+	// paths of the transferred files, relative to the target
+	Transferred []string
+	// paths deleted from the target, relative to the target
+	Deleted []string
+}
+
+// Synchronize a directory to a remote server using rsync over the same SSH credentials.
+// Only files whose contents differ are transferred; the contents of the source are placed directly in the target.
+//
+// Note: Requires a shell and rsync on the remote server, so it does not work with SFTP-only accounts. Files are compared by checksum, since Dagger does not preserve modification times.
+func (s *ScpCommander) SyncDirectory(
+	ctx context.Context,
+	// source directory
+	source *dagger.Directory,
+	// destination path
+	target string,
+	// delete files in the target that do not exist in the source
+	// +optional
+	delete bool,
+	// rsync exclude patterns (e.g. node_modules, *.tmp)
+	// +optional
+	excludes []string,
+) (*SyncResult, error) {
+	sourcePath := "/source-dir"
+
+	args := append(s.rsyncCommand(), "--archive", "--checksum", "--out-format=%i %n")
+	if delete {
+		args = append(args, "--delete")
+	}
+	for _, exclude := range excludes {
+		args = append(args, "--exclude="+exclude)
+	}
+	args = append(args, sourcePath+"/", s.Destination+":"+strings.TrimSuffix(target, "/")+"/")
+
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithDirectory(sourcePath, source)
+
+	ctr, err := s.exec(ctx, ctr, auditEntry{
+		Transfer: "sync",
+		Source:   sourcePath,
+		Target:   target,
+	}, sourcePath, args)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ctr.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSyncOutput(out), nil
+}
+
+// Parse the itemized rsync output ('%i %n') into transferred and deleted paths.
+func parseSyncOutput(out string) *SyncResult {
+	result := &SyncResult{
+		Transferred: []string{},
+		Deleted:     []string{},
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		// The itemized changes are 11 characters wide, followed by a space and the path.
+		if len(line) < 13 {
+			continue
+		}
+		item, name := line[:11], line[12:]
+
+		switch {
+		case strings.HasPrefix(item, "*deleting"):
+			result.Deleted = append(result.Deleted, name)
+		case item[0] == '<' || item[0] == '>':
+			result.Transferred = append(result.Transferred, name)
+		}
+	}
+
+	return result
+}
+
+// Returns the rsync command that connects with the SSH credentials and the transfer options.
+func (s *ScpCommander) rsyncCommand() []string {
+	cmd := []string{"rsync", "--rsh=" + rshCommand(s.SshBaseCommand)}
+	if s.Compress {
+		cmd = append(cmd, "--compress")
+	}
+	if s.BandwidthLimitKbps > 0 {
+		// rsync limits in KiB/s rather than Kbit/s
+		cmd = append(cmd, fmt.Sprintf("--bwlimit=%d", max(s.BandwidthLimitKbps/8, 1)))
+	}
+	return cmd
+}
+
+// Returns rsync filter options that transfer at least the files selected by the include and exclude glob patterns,
+// anchored at the transfer root. filterDirectory makes the exact selection afterwards.
+func rsyncFilters(include []string, exclude []string) []string {
+	var args []string
+	for _, pattern := range exclude {
+		for _, variant := range globVariants(pattern) {
+			args = append(args, "--exclude=/"+variant)
+		}
+	}
+	if len(include) == 0 {
+		return args
+	}
+
+	// Every directory is visited, so that matching files in it can be included; empty ones are pruned.
+	args = append(args, "--include=*/")
+	for _, pattern := range include {
+		for _, variant := range globVariants(pattern) {
+			// A matching directory is included with its contents.
+			args = append(args, "--include=/"+variant, "--include=/"+variant+"/***")
+		}
+	}
+	return append(args, "--exclude=*", "--prune-empty-dirs")
+}
+
+// Join args into a command for rsync's --rsh option.
+// rsync splits it on spaces and honors single quotes, where a doubled single quote stands for one.
+func rshCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Directions of a tar stream over ssh
+const (
+	streamUpload   = "upload"
+	streamDownload = "download"
+)
+
+// Local shell script that streams the contents of "$1" as a compressed tar archive to the rest of "$@".
+const tarUploadScript = `
+set -o pipefail
+dir=$1; shift
+tar -C "$dir" -czf - . | "$@"
+`
+
+// Local shell script that extracts the compressed tar archive written by the rest of "$@" into "$1",
+// keeping symlinks and permissions.
+const tarDownloadScript = `
+set -o pipefail
+dir=$1; shift
+mkdir -p "$dir"
+"$@" | tar -C "$dir" -xzpf -
+`
+
+// Local shell script that runs "$@" with the stream in the direction "$2" limited to "$1" bytes per second.
+const throttleScript = `
+set -o pipefail
+rate=$1; direction=$2; shift 2
+if [ "$direction" = upload ]; then
+	pv -q -L "$rate" | "$@"
+else
+	"$@" | pv -q -L "$rate"
+fi
+`
+
+// Returns the command that runs the remote script over ssh for a tar stream in the given direction.
+// Tar streams do not go through scp or rsync, so the bandwidth limit is applied to them with pv.
+func (s *ScpCommander) sshStream(direction string, script string) []string {
+	if s.BandwidthLimitKbps <= 0 {
+		return s.sshExec(script)
+	}
+	rate := strconv.Itoa(s.BandwidthLimitKbps * 1000 / 8)
+	return append([]string{"bash", "-c", throttleScript, "throttle", rate, direction}, s.sshExec(script)...)
+}
+
+// Returns the command that uploads the contents of localDir into remoteDir over a single ssh channel.
+func (s *ScpCommander) tarUploadCommand(localDir string, remoteDir string) []string {
+	remote := fmt.Sprintf("t=%s\nz=z\n%s", shellQuote(remoteDir), tarTargetScript)
+	return append([]string{"bash", "-c", tarUploadScript, "tar-upload", localDir}, s.sshStream(streamUpload, remote)...)
+}
+
+// Returns the command that downloads the contents of remoteDir into localDir over a single ssh channel,
+// leaving out the files matched by the exclude glob patterns.
+// As in the upload filters, only '**' matches across directories: GNU tar lets any wildcard match '/' by default.
+func (s *ScpCommander) tarDownloadCommand(remoteDir string, localDir string, exclude []string) []string {
+	options := []string{"--anchored"}
+	for _, pattern := range exclude {
+		for _, variant := range globVariants(pattern) {
+			if strings.Contains(variant, "**") {
+				options = append(options, "--wildcards-match-slash")
+			} else {
+				options = append(options, "--no-wildcards-match-slash")
+			}
+			options = append(options, shellQuote("--exclude=./"+variant))
+		}
+	}
+	remote := fmt.Sprintf("set -- %s\ndir=%s\nname=.\nz=z\n%s", strings.Join(options, " "), shellQuote(remoteDir), tarSourceScript)
+	return append([]string{"bash", "-c", tarDownloadScript, "tar-download", localDir}, s.sshStream(streamDownload, remote)...)
+}
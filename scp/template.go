@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/scp/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Data passed to the templates of TemplateToRemote
+type templateData struct {
+	Values  map[string]any
+	Secrets map[string]any
+}
+
+// Render a Go template and upload the result to a remote server.
+// The template refers to plain values as '{{ .Values.name }}' and to secret values as '{{ .Secrets.name }}';
+// a missing value is an error.
+//
+// The rendered file is only mounted as a secret, so secret values are never written into a cached layer,
+// and it is created on the remote server with restricted permissions.
+// The uploaded file is named after the template, without a '.tmpl' or '.tpl' extension, when the target is a directory.
+//
+// Note: Do not use the 'forever' cache policy with templates. Secret values do not invalidate the cache,
+// so a file rendered with changed secrets would never be uploaded.
+func (s *ScpCommander) TemplateToRemote(
+	ctx context.Context,
+	// Go template (text/template)
+	template *dagger.File,
+	// destination path
+	target string,
+	// plain values as a JSON object (e.g. {"port": 8080})
+	// +optional
+	values string,
+	// secret values as a JSON object
+	// +optional
+	secrets *dagger.Secret,
+	// mode to set on the uploaded file in octal
+	// +optional
+	// +default="0600"
+	mode string,
+	// owner to set on the uploaded file as user or user:group (uses sudo unless connected as root)
+	// +optional
+	owner string,
+) (*dagger.Container, error) {
+	if err := validateMode(mode); err != nil {
+		return nil, err
+	}
+
+	name, err := template.Name(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".tmpl"), ".tpl")
+
+	rendered, err := renderTemplate(ctx, template, values, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	secretName, err := templateSecretName(ctx, template, values, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	localPath := path.Join("/template", name)
+	ctr := s.BaseCtr.
+		With(withCachePolicy(s.CachePolicy, s.CacheKey)).
+		WithMountedSecret(localPath, dag.SetSecret(secretName, rendered), dagger.ContainerWithMountedSecretOpts{
+			// scp creates a new remote file with the mode of the source
+			Mode: 0600,
+		})
+
+	ctr, err = s.exec(ctx, ctr, auditEntry{
+		Transfer: "template",
+		Source:   name,
+		Target:   target,
+	}, localPath, append(s.scpCommand(false), localPath, s.Destination+":"+target))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.setFileAttributes(ctx, ctr, name, target, mode, owner)
+}
+
+// Render the template with the plain and secret JSON values.
+func renderTemplate(ctx context.Context, file *dagger.File, values string, secrets *dagger.Secret) (string, error) {
+	text, err := file.Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	data := templateData{
+		Values:  map[string]any{},
+		Secrets: map[string]any{},
+	}
+	if values != "" {
+		if err := json.Unmarshal([]byte(values), &data.Values); err != nil {
+			return "", fmt.Errorf("invalid template values: %w", err)
+		}
+	}
+	if secrets != nil {
+		plaintext, err := secrets.Plaintext(ctx)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal([]byte(plaintext), &data.Secrets); err != nil {
+			// The error message may quote the secret, so it is not wrapped.
+			return "", fmt.Errorf("invalid template secrets: not a JSON object")
+		}
+	}
+
+	tmpl, err := template.New("template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Returns the name of the secret holding the file rendered from the template, the values and the secrets,
+// so that concurrent renders with different inputs do not replace each other's secret.
+func templateSecretName(ctx context.Context, template *dagger.File, values string, secrets *dagger.Secret) (string, error) {
+	id, err := template.ID(ctx)
+	if err != nil {
+		return "", err
+	}
+	secretsName := ""
+	if secrets != nil {
+		secretsName, err = secrets.Name(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("scp-template-%x", sha256.Sum256([]byte(string(id)+"\x00"+values+"\x00"+secretsName))), nil
+}
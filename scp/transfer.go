@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Path of the statistics written by transferStatsScript.
+const transferStatsPath = "/tmp/transfer-stats"
+
+// Local shell script that runs the rest of "$@", timing it, and writes the statistics of the local path "$1" to "$2":
+// a 'files bytes milliseconds' line followed by the paths of the files relative to "$1".
+const transferStatsScript = `
+src=$1; out=$2; shift 2
+start=$(date +%s%N)
+"$@" || exit $?
+end=$(date +%s%N)
+{
+	echo "$(find "$src" -type f | wc -l) $(find "$src" -type f -printf '%s\n' | awk '{ s += $1 } END { print s + 0 }') $(( (end - start) / 1000000 ))"
+	find "$src" -type f -printf '%P\n' | sort
+} > "$out"
+`
+
+// Local shell script that prints the output of the rest of "$@", or "$1" if it fails or prints nothing.
+const resolvePathScript = `
+fallback=$1; shift
+p=$("$@" 2>/dev/null) && [ -n "$p" ] || p=$fallback
+printf '%s\n' "$p"
+`
+
+// Result of a transfer to a remote server
+type TransferResult struct {
+	// container that ran the transfer
+	Container *dagger.Container
+	// number of files transferred
+	Files int
+	// total size of the transferred files in bytes
+	Bytes int
+	// duration of the transfer in milliseconds
+	DurationMs int
+	// average throughput in bytes per second
+	BytesPerSecond int
+	// remote path of the uploaded file or directory
+	Path string
+	// remote paths of the transferred files
+	Paths []string
+}
+
+// Wrap a transfer command so that it records the statistics of localPath at transferStatsPath.
+func transferStats(localPath string, args []string) []string {
+	return append([]string{"bash", "-c", transferStatsScript, "stats", localPath, transferStatsPath}, args...)
+}
+
+// Collect the result of a transfer recorded by transferStats in ctr.
+// The remote path is printed by the remote script resolve, or is fallback if it is not given or fails.
+// For a directory, the paths of the files are joined to the remote path.
+func (s *ScpCommander) transferResult(
+	ctx context.Context,
+	ctr *dagger.Container,
+	resolve string,
+	fallback string,
+	directory bool,
+) (*TransferResult, error) {
+	stats, err := ctr.File(transferStatsPath).Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remotePath := fallback
+	if resolve != "" {
+		// The script prints the fallback if the remote resolution fails, so only the local exec can fail here.
+		ctr, err = s.exec(ctx, ctr, auditEntry{
+			Transfer: "resolve",
+			Target:   fallback,
+		}, "", append([]string{"bash", "-c", resolvePathScript, "resolve", fallback}, s.sshExec(resolve)...))
+		if err != nil {
+			return nil, err
+		}
+		out, err := ctr.Stdout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		remotePath = strings.TrimSpace(out)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stats), "\n")
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected transfer statistics %q", lines[0])
+	}
+	values := make([]int, len(fields))
+	for i, field := range fields {
+		if values[i], err = strconv.Atoi(field); err != nil {
+			return nil, fmt.Errorf("unexpected transfer statistics %q", lines[0])
+		}
+	}
+
+	result := &TransferResult{
+		Container:      ctr,
+		Files:          values[0],
+		Bytes:          values[1],
+		DurationMs:     values[2],
+		BytesPerSecond: values[1] * 1000 / max(values[2], 1),
+		Path:           remotePath,
+		Paths:          []string{},
+	}
+	if !directory {
+		result.Paths = append(result.Paths, remotePath)
+		return result, nil
+	}
+	for _, name := range lines[1:] {
+		if name != "" {
+			result.Paths = append(result.Paths, path.Join(remotePath, name))
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"dagger/scp/internal/dagger"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Local shell script that compares the SHA-256 checksums of uploaded files with their remote copies.
+// It hashes "$VERIFY_FILE", or every file below "$VERIFY_DIR",
+// and feeds the manifest to "$@", which checks it on the remote server with 'sha256sum -c'.
+const verifyScript = `
+cd "${VERIFY_DIR:-.}" || exit 1
+if [ -n "$VERIFY_FILE" ]; then
+	sha256sum -- "$VERIFY_FILE" > /tmp/verify.manifest || exit 1
+else
+	find . -type f -print0 | sort -z | xargs -0 -r sha256sum > /tmp/verify.manifest || exit 1
+fi
+"$@" < /tmp/verify.manifest > /tmp/verify.out 2>&1
+code=$?
+failed=$(grep ': FAILED' /tmp/verify.out | sed -e 's/: FAILED.*$//' -e 's|^\./||')
+if [ -n "$failed" ]; then
+	echo "checksum verification failed for:" >&2
+	echo "$failed" | sed 's/^/  /' >&2
+	exit 1
+fi
+if [ $code -ne 0 ]; then
+	cat /tmp/verify.out >&2
+	exit $code
+fi
+rm -f /tmp/verify.manifest /tmp/verify.out
+`
+
+// Remote script that checks a single-file manifest against the uploaded file "$f".
+const verifyRemoteFileScript = `
+read -r hash _
+echo "$hash  $f" | sha256sum -c --quiet -
+`
+
+// Remote script that checks a directory manifest against the uploaded directory "$base".
+const verifyRemoteDirectoryScript = `
+cd "$base" && sha256sum -c --quiet -
+`
+
+// Local shell script that checks a downloaded file against an expected SHA-256 digest.
+const checkDigestScript = `
+actual=$(sha256sum -- "$1" | cut -d' ' -f1)
+if [ "$actual" != "$2" ]; then
+	echo "checksum mismatch for $1: expected $2, got $actual" >&2
+	exit 1
+fi
+`
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Verify the file name, uploaded to target, against its remote copy.
+func (s *ScpCommander) verifyFile(ctx context.Context, ctr *dagger.Container, name string, target string) (*dagger.Container, error) {
+	remote := uploadedFileScript(target, path.Base(name), verifyRemoteFileScript)
+
+	ctr, err := s.exec(ctx, ctr.WithEnvVariable("VERIFY_FILE", name), auditEntry{
+		Transfer: "verify",
+		Source:   name,
+		Target:   target,
+	}, "", append([]string{"bash", "-c", verifyScript, "verify"}, s.sshExec(remote)...))
+	if err != nil {
+		return nil, err
+	}
+	return ctr.WithoutEnvVariable("VERIFY_FILE"), nil
+}
+
+// Verify the files below localDir against the directory uploaded to target.
+// If nested is true, the files may have been copied into '[target]/[base name of localDir]'.
+func (s *ScpCommander) verifyDirectory(ctx context.Context, ctr *dagger.Container, localDir string, target string, nested bool) (*dagger.Container, error) {
+	remote := uploadedDirectoryScript(target, path.Base(localDir), nested, verifyRemoteDirectoryScript)
+
+	ctr, err := s.exec(ctx, ctr.WithEnvVariable("VERIFY_DIR", localDir), auditEntry{
+		Transfer: "verify",
+		Source:   localDir,
+		Target:   target,
+	}, "", append([]string{"bash", "-c", verifyScript, "verify"}, s.sshExec(remote)...))
+	if err != nil {
+		return nil, err
+	}
+	return ctr.WithoutEnvVariable("VERIFY_DIR"), nil
+}
+
+// Normalize an expected SHA-256 digest, accepting an optional 'sha256:' prefix.
+func parseSha256(digest string) (string, error) {
+	digest = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(digest), "sha256:"))
+	if !sha256Pattern.MatchString(digest) {
+		return "", fmt.Errorf("invalid SHA-256 digest %q", digest)
+	}
+	return digest, nil
+}
+
+// Check whether the top level of a directory contains an entry with the given name.
+func containsEntry(ctx context.Context, dir *dagger.Directory, name string) (bool, error) {
+	entries, err := dir.Entries(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if strings.TrimSuffix(entry, "/") == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var identityNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Named SSH identity
+type SshCredentialIdentity struct {
+	// identity name
+	Name string
+	// host patterns that use this identity
+	Hosts []string
+	// credentials of the identity
+	Credential *SshCredential
+}
+
+// Returns the path prefix to mount the files of the identity at (see Mount).
+// Each identity has its own paths ('/identities/[name]_key', ...), so several identities can be used in the same container.
+func (i *SshCredentialIdentity) Path() string {
+	return "/identities/" + i.Name
+}
+
+// Named SSH identities, selected by the host to connect to
+type SshCredentialKeyring struct {
+	// +private
+	Identities []*SshCredentialIdentity
+}
+
+// Create an empty keyring.
+func (c *SshCredential) Keyring() *SshCredentialKeyring {
+	return &SshCredentialKeyring{}
+}
+
+// Returns the identity to connect to destination with this credential without a keyring.
+// Its name is derived from the destination.
+func (c *SshCredential) Identity(
+	// SSH destination ([user@]host), SSH URL or scp-like address
+	destination string,
+) *SshCredentialIdentity {
+	return &SshCredentialIdentity{
+		Name:       fmt.Sprintf("%x", sha256.Sum256([]byte(destination)))[:12],
+		Credential: c,
+	}
+}
+
+// Add a named identity to the keyring.
+func (k *SshCredentialKeyring) WithIdentity(
+	// identity name
+	name string,
+	// credentials of the identity
+	credential *SshCredential,
+	// host patterns that use this identity, with '*' and '?' wildcards (e.g. *.internal.example.com)
+	// (If not entered, the identity is used for hosts that no other identity matches)
+	// +optional
+	hosts []string,
+) (*SshCredentialKeyring, error) {
+	if !identityNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid identity name %q: use letters, digits, '.', '_' or '-'", name)
+	}
+	for _, identity := range k.Identities {
+		if identity.Name == name {
+			return nil, fmt.Errorf("identity %q already exists in the keyring", name)
+		}
+	}
+	for _, host := range hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", host)
+		}
+	}
+	if err := credential.Validate(); err != nil {
+		return nil, fmt.Errorf("identity %q: %w", name, err)
+	}
+
+	k.Identities = append(k.Identities, &SshCredentialIdentity{
+		Name:       name,
+		Hosts:      hosts,
+		Credential: credential,
+	})
+	return k, nil
+}
+
+// Returns the identity to connect to destination:
+// the first one with a pattern matching its host, or else the first one without host patterns.
+func (k *SshCredentialKeyring) Identity(
+	// SSH destination ([user@]host), SSH URL or scp-like address
+	destination string,
+) (*SshCredentialIdentity, error) {
+	host := destinationHost(destination)
+
+	var fallback *SshCredentialIdentity
+	for _, identity := range k.Identities {
+		if len(identity.Hosts) == 0 && fallback == nil {
+			fallback = identity
+		}
+		for _, pattern := range identity.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				return identity, nil
+			}
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no identity in the keyring matches host %q", host)
+	}
+	return fallback, nil
+}
+
+// Returns the host of an SSH destination ([user@]host), an SSH URL (ssh://[user@]host[:port]/path)
+// or an scp-like address ([user@]host:path).
+func destinationHost(destination string) string {
+	if strings.Contains(destination, "://") {
+		if u, err := url.Parse(destination); err == nil {
+			return u.Hostname()
+		}
+	}
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		destination = destination[i+1:]
+	}
+	host, _, _ := strings.Cut(destination, ":")
+	return host
+}
@@ -0,0 +1,166 @@
+// SSH connection credentials
+//
+// Credentials and keyrings shared by the ssh, scp and private-git modules, which accept them as arguments.
+package main
+
+import (
+	"dagger/ssh-credential/internal/dagger"
+	"errors"
+)
+
+// SSH connection credentials
+type SshCredential struct {
+	// +private
+	Password *dagger.Secret
+	// +private
+	Key *dagger.Secret
+	// +private
+	Passphrase *dagger.Secret
+	// +private
+	Certificate *dagger.File
+	// +private
+	Agent *dagger.Socket
+	// +private
+	KnownHosts *dagger.File
+}
+
+// Authenticate with a password.
+func (c *SshCredential) WithPassword(
+	// password
+	password *dagger.Secret,
+) *SshCredential {
+	c.Password = password
+	return c
+}
+
+// Authenticate with a private key.
+//
+// Note: Tested against RSA-formatted and OPENSSH-formatted private keys.
+func (c *SshCredential) WithKey(
+	// private key
+	key *dagger.Secret,
+	// passphrase of an encrypted private key
+	// +optional
+	passphrase *dagger.Secret,
+) *SshCredential {
+	c.Key = key
+	c.Passphrase = passphrase
+	return c
+}
+
+// Present a certificate signed by a trusted CA along with the private key.
+func (c *SshCredential) WithCertificate(
+	// certificate file (e.g. id_ed25519-cert.pub)
+	certificate *dagger.File,
+) *SshCredential {
+	c.Certificate = certificate
+	return c
+}
+
+// Authenticate with the keys of an SSH agent.
+func (c *SshCredential) WithAgent(
+	// SSH agent socket (e.g. env:SSH_AUTH_SOCK)
+	socket *dagger.Socket,
+) *SshCredential {
+	c.Agent = socket
+	return c
+}
+
+// Verify the server against known hosts instead of accepting any host key.
+func (c *SshCredential) WithKnownHosts(
+	// known_hosts file
+	knownHosts *dagger.File,
+) *SshCredential {
+	c.KnownHosts = knownHosts
+	return c
+}
+
+// Check that the credential can be used to connect.
+func (c *SshCredential) Validate() error {
+	switch {
+	case c.Password == nil && c.Key == nil && c.Agent == nil:
+		return errors.New("credential requires a password, a key or an agent")
+	case c.Password != nil && (c.Key != nil || c.Agent != nil):
+		return errors.New("a password cannot be combined with a key or an agent")
+	case c.Certificate != nil && c.Key == nil:
+		return errors.New("a certificate requires a key")
+	}
+	return nil
+}
+
+// Mount the credential files into a container at paths starting with path.
+func (c *SshCredential) Mount(
+	// container to mount the files into
+	ctr *dagger.Container,
+	// path prefix of the mounted files (e.g. /identities/deploy)
+	path string,
+) *dagger.Container {
+	switch {
+	case c.Password != nil:
+		ctr = ctr.WithMountedSecret(path+"_password", c.Password)
+	case c.Passphrase != nil:
+		ctr = ctr.WithMountedSecret(path+"_passphrase", c.Passphrase)
+	}
+	if c.Key != nil {
+		ctr = ctr.WithMountedSecret(path+"_key", c.Key)
+		if c.Certificate != nil {
+			ctr = ctr.WithMountedFile(path+"_key-cert.pub", c.Certificate)
+		}
+	}
+	if c.Agent != nil {
+		ctr = ctr.WithUnixSocket(path+"_agent.sock", c.Agent)
+	}
+	if c.KnownHosts != nil {
+		ctr = ctr.WithMountedFile(path+"_known_hosts", c.KnownHosts)
+	}
+	return ctr
+}
+
+// Returns the command that runs program (ssh, scp or sftp) with the credential files mounted by Mount at path.
+// A password or passphrase is answered by sshpass from its mounted file, so it never appears in the command.
+func (c *SshCredential) Command(
+	// program to run (e.g. ssh)
+	program string,
+	// path prefix passed to Mount
+	path string,
+) ([]string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var cmd []string
+	switch {
+	case c.Password != nil:
+		cmd = append(cmd, "sshpass", "-f", path+"_password")
+	case c.Passphrase != nil:
+		cmd = append(cmd, "sshpass", "-P", "passphrase", "-f", path+"_passphrase")
+	}
+	cmd = append(cmd, program)
+
+	if c.Key != nil {
+		cmd = append(cmd, "-i", path+"_key")
+		if c.Certificate != nil {
+			cmd = append(cmd, "-o", "CertificateFile="+path+"_key-cert.pub")
+		}
+	}
+	if c.Agent != nil {
+		cmd = append(cmd, "-o", "IdentityAgent="+path+"_agent.sock")
+	}
+	if c.KnownHosts != nil {
+		cmd = append(cmd, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+path+"_known_hosts")
+	} else {
+		cmd = append(cmd, "-o", "StrictHostKeyChecking=no")
+	}
+	return cmd, nil
+}
+
+// Returns the password and passphrase secrets of the credential, to redact them from logs.
+func (c *SshCredential) Secrets() []*dagger.Secret {
+	var secrets []*dagger.Secret
+	for _, secret := range []*dagger.Secret{c.Password, c.Passphrase} {
+		if secret != nil {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
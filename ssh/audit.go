@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"dagger/ssh/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// +private
+const AuditLogPath = "/var/log/dagger-ssh-audit.jsonl"
+
+// Placeholder written to the audit transcript in place of secret values.
+const redacted = "[REDACTED]"
+
+// Records a single command in the audit transcript.
+// Timestamps, exit code and byte counts are filled in by the shell at run time.
+// The exit code of the command is passed on, so the exec is run expecting any exit code.
+const auditScript = `
+started=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+"$@" >/tmp/audit.stdout 2>/tmp/audit.stderr
+code=$?
+finished=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+cat /tmp/audit.stdout
+cat /tmp/audit.stderr >&2
+mkdir -p "$(dirname "$AUDIT_LOG")"
+printf '%s,"started_at":"%s","finished_at":"%s","exit_code":%d,"stdout_bytes":%d,"stderr_bytes":%d}\n' \
+	"$AUDIT_ENTRY" "$started" "$finished" "$code" \
+	"$(wc -c </tmp/audit.stdout)" "$(wc -c </tmp/audit.stderr)" >>"$AUDIT_LOG"
+rm -f /tmp/audit.stdout /tmp/audit.stderr
+exit $code
+`
+
+// Static part of an audit record, known before the command runs.
+type auditEntry struct {
+	Destination string `json:"destination"`
+	Command     string `json:"command"`
+}
+
+// Run args in ctr and append an audit record for it to AuditLogPath.
+// The record is written even if the command fails, in which case the returned error contains the record.
+func auditExec(ctx context.Context, ctr *dagger.Container, entry auditEntry, args []string) (*dagger.Container, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = ctr.
+		WithEnvVariable("AUDIT_LOG", AuditLogPath).
+		WithEnvVariable("AUDIT_ENTRY", strings.TrimSuffix(string(b), "}")).
+		WithExec(append([]string{"bash", "-c", auditScript, "audit"}, args...), dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	code, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, auditError(ctx, ctr, code)
+	}
+
+	return ctr.
+		WithoutEnvVariable("AUDIT_ENTRY").
+		WithoutEnvVariable("AUDIT_LOG"), nil
+}
+
+// Returns the error of a failed audited exec in ctr, with its stderr and audit record.
+func auditError(ctx context.Context, ctr *dagger.Container, code int) error {
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return err
+	}
+	log, err := ctr.File(AuditLogPath).Contents(ctx)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	return fmt.Errorf("exit code %d: %s\naudit record: %s", code, strings.TrimSpace(stderr), lines[len(lines)-1])
+}
+
+// Replace every secret value in text with a placeholder.
+func redact(ctx context.Context, text string, secrets []*dagger.Secret) (string, error) {
+	for _, secret := range secrets {
+		plain, err := secret.Plaintext(ctx)
+		if err != nil {
+			return "", err
+		}
+		if plain == "" {
+			continue
+		}
+		text = strings.ReplaceAll(text, plain, redacted)
+	}
+	return text, nil
+}
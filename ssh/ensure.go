@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var modePattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// Remote shell snippet that replaces "$p" with "$new" when they differ and reports the result.
+// An existing file keeps its mode and owner, a new one is created with mode 644.
+const replaceIfChanged = `
+if [ -f "$p" ] && cmp -s "$new" "$p"; then
+	rm -f "$new"
+	echo unchanged
+elif [ -f "$p" ]; then
+	cat "$new" > "$p" && rm -f "$new" && echo changed
+else
+	chmod 644 "$new" && mv -f "$new" "$p" && echo changed
+fi
+`
+
+// Remote script for EnsureLine.
+// The last line matching "$re" is replaced, otherwise the line is appended unless it is already present.
+const ensureLineScript = `
+line=$(cat)
+src="$p"; [ -f "$p" ] || src=/dev/null
+new=$(mktemp "$(dirname "$p")/.ensure.XXXXXX") || exit 1
+line="$line" re="$re" awk '
+	BEGIN { line = ENVIRON["line"]; re = ENVIRON["re"] }
+	NR == FNR { if (re != "" && $0 ~ re) last = FNR; if ($0 == line) exact = 1; next }
+	FNR == last { print line; next }
+	{ print }
+	END { if (!last && !exact) print line }
+' "$src" "$src" > "$new" || { rm -f "$new"; exit 1; }
+` + replaceIfChanged
+
+// Remote script for EnsureBlock.
+// The block between the markers is replaced in place, or appended when the markers are missing.
+// An empty block removes the markers and everything between them.
+const ensureBlockScript = `
+block=$(cat)
+src="$p"; [ -f "$p" ] || src=/dev/null
+new=$(mktemp "$(dirname "$p")/.ensure.XXXXXX") || exit 1
+block="$block" begin="# BEGIN $marker" end="# END $marker" awk '
+	BEGIN { block = ENVIRON["block"]; begin = ENVIRON["begin"]; end = ENVIRON["end"] }
+	function emit() { if (!done && block != "") { print begin; print block; print end } done = 1 }
+	$0 == begin { inblock = 1; emit(); next }
+	inblock { if ($0 == end) inblock = 0; next }
+	{ print }
+	END { emit() }
+' "$src" > "$new" || { rm -f "$new"; exit 1; }
+if [ ! -f "$p" ] && [ ! -s "$new" ]; then
+	rm -f "$new"
+	echo unchanged
+	exit 0
+fi
+` + replaceIfChanged
+
+// Remote script for EnsureFile.
+// Mode and owner are only enforced when given.
+const ensureFileScript = `
+new=$(mktemp "$(dirname "$p")/.ensure.XXXXXX") || exit 1
+cat > "$new"
+result=$(` + replaceIfChanged + `) || exit 1
+if [ -n "$mode" ] && [ $((0$(stat -c %a "$p"))) -ne $((0$mode)) ]; then
+	chmod "$mode" "$p" || exit 1
+	result=changed
+fi
+if [ -n "$owner" ]; then
+	current=$(stat -c %U:%G "$p")
+	case "$owner" in *:*) ;; *) current=${current%%:*} ;; esac
+	if [ "$current" != "$owner" ]; then
+		sudo=; [ "$(id -u)" -eq 0 ] || sudo="sudo -n"
+		$sudo chown "$owner" "$p" || exit 1
+		result=changed
+	fi
+fi
+echo "$result"
+`
+
+// Ensure a line is present in a file on the remote server.
+// If regexp is given, the last line matching it is replaced by the line; otherwise the line is appended unless it already exists.
+// The file is created if it does not exist.
+//
+// Returns whether the file was changed.
+func (s *SshCommander) EnsureLine(
+	ctx context.Context,
+	// remote file path
+	path string,
+	// line to ensure
+	line string,
+	// POSIX extended regular expression for the line to replace
+	// +optional
+	regexp string,
+) (bool, error) {
+	if strings.Contains(line, "\n") {
+		return false, fmt.Errorf("line must not contain a newline")
+	}
+
+	return s.ensure(ctx, ensureLineScript, line, map[string]string{
+		"p":  path,
+		"re": regexp,
+	})
+}
+
+// Ensure a block of lines is present in a file on the remote server, surrounded by '# BEGIN marker' and '# END marker' lines.
+// An existing block with the same marker is replaced in place; an empty content removes the block.
+// The file is created if it does not exist.
+//
+// Returns whether the file was changed.
+func (s *SshCommander) EnsureBlock(
+	ctx context.Context,
+	// remote file path
+	path string,
+	// name that identifies the block
+	marker string,
+	// content of the block
+	// +optional
+	content string,
+) (bool, error) {
+	if marker == "" || strings.Contains(marker, "\n") {
+		return false, fmt.Errorf("marker must be a non-empty single line")
+	}
+
+	return s.ensure(ctx, ensureBlockScript, strings.TrimRight(content, "\n"), map[string]string{
+		"p":      path,
+		"marker": marker,
+	})
+}
+
+// Ensure a file on the remote server has the given content, and optionally mode and owner.
+// A new file is created with mode 644 unless a mode is given.
+//
+// Returns whether the file was changed.
+func (s *SshCommander) EnsureFile(
+	ctx context.Context,
+	// remote file path
+	path string,
+	// file content
+	content string,
+	// file mode in octal (e.g. 0644)
+	// +optional
+	mode string,
+	// file owner as user or user:group (uses sudo unless connected as root)
+	// +optional
+	owner string,
+) (bool, error) {
+	if mode != "" && !modePattern.MatchString(mode) {
+		return false, fmt.Errorf("invalid mode %q: use octal digits (e.g. 0644)", mode)
+	}
+
+	return s.ensure(ctx, ensureFileScript, content, map[string]string{
+		"p":     path,
+		"mode":  mode,
+		"owner": owner,
+	})
+}
+
+// Run an ensure script with the given variables and input, and report whether it changed anything.
+func (s *SshCommander) ensure(ctx context.Context, script string, input string, vars map[string]string) (bool, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefix := ""
+	for _, name := range names {
+		prefix += fmt.Sprintf("%s=%s\n", name, shellQuote(vars[name]))
+	}
+
+	ctr, err := s.scriptWithInput(ctx, prefix+script, input)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := ctr.Stdout(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	switch result := strings.TrimSpace(out); result {
+	case "changed":
+		return true, nil
+	case "unchanged":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: unexpected output %q", vars["p"], result)
+	}
+}
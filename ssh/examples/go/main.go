@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"dagger/examples/internal/dagger"
+	"fmt"
 )
 
 type Examples struct{}
@@ -39,3 +41,107 @@ func (e *Examples) SSH_UseKeyWithOption(sshd *dagger.Service, key *dagger.Secret
 		WithIdentityFile(key).
 		Command(`echo "Hello, world!"`)
 }
+
+func (e *Examples) SSH_Audit(destination string, password string) *dagger.File {
+	commander := dag.SSH().
+		Config(destination).
+		WithPassword(dag.SetSecret("password", password)).
+		WithAudit()
+
+	return commander.AuditLog(commander.Command(`echo "Hello, world!"`))
+}
+
+func (e *Examples) SSH_ReadFile(ctx context.Context, destination string, key *dagger.Secret, path string) (string, error) {
+	commander := dag.SSH().
+		Config(destination).
+		WithIdentityFile(key)
+
+	exists, err := commander.FileExists(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%s does not exist", path)
+	}
+
+	return commander.ReadFile(ctx, path)
+}
+
+func (e *Examples) SSH_EnsureLine(ctx context.Context, destination string, key *dagger.Secret) (bool, error) {
+	return dag.SSH().
+		Config(destination).
+		WithIdentityFile(key).
+		EnsureLine(ctx, "/home/admin/.profile", "export APP_ENV=production", dagger.SSHCommanderEnsureLineOpts{
+			Regexp: "^export APP_ENV=",
+		})
+}
+
+func (e *Examples) SSH_WithLock(destination string, key *dagger.Secret) *dagger.Container {
+	return dag.SSH().
+		Config(destination).
+		WithIdentityFile(key).
+		WithLock("deploy", dagger.SSHCommanderWithLockOpts{
+			Timeout: 300,
+			Holder:  "examples/ssh-with-lock",
+		}).
+		Command(`echo "deploying" && sleep 10`)
+}
+
+func (e *Examples) SSH_LockSequence(ctx context.Context, destination string, key *dagger.Secret) (*dagger.Container, error) {
+	locked := dag.SSH().
+		Config(destination).
+		WithIdentityFile(key).
+		WithLock("deploy", dagger.SSHCommanderWithLockOpts{
+			Timeout: 300,
+			Holder:  "examples/ssh-lock-sequence",
+		}).
+		Lock()
+
+	if _, err := locked.Command("systemctl stop app").Sync(ctx); err != nil {
+		return nil, err
+	}
+	ctr, err := locked.Command("systemctl start app").Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := locked.Unlock().ID(ctx); err != nil {
+		return nil, err
+	}
+	return ctr, nil
+}
+
+func (e *Examples) SSH_UseCredential(destination string, key *dagger.Secret, passphrase *dagger.Secret, knownHosts *dagger.File) *dagger.Container {
+	credential := dag.SSHCredential().
+		WithKey(key, dagger.SSHCredentialWithKeyOpts{
+			Passphrase: passphrase,
+		}).
+		WithKnownHosts(knownHosts)
+
+	return dag.SSH().
+		Config(destination).
+		WithCredential(credential).
+		Command(`echo "Hello, world!"`)
+}
+
+func (e *Examples) SSH_UseKeyring(bastionKey *dagger.Secret, appKey *dagger.Secret) *dagger.Container {
+	keyring := dag.SSHCredential().
+		Keyring().
+		WithIdentity("bastion", dag.SSHCredential().WithKey(bastionKey), dagger.SSHCredentialKeyringWithIdentityOpts{
+			Hosts: []string{"bastion.example.com"},
+		}).
+		WithIdentity("app", dag.SSHCredential().WithKey(appKey), dagger.SSHCredentialKeyringWithIdentityOpts{
+			Hosts: []string{"*.app.example.com"},
+		})
+
+	bastion := dag.SSH().
+		Config("admin@bastion.example.com").
+		WithKeyring(keyring).
+		Command("uptime")
+
+	return dag.SSH().
+		Config("deploy@web1.app.example.com", dagger.SSHConfigOpts{
+			BaseCtr: bastion,
+		}).
+		WithKeyring(keyring).
+		Command("uptime")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"dagger/ssh/internal/dagger"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// The remote path does not exist.
+	ErrNotFound = errors.New("no such file or directory")
+	// The remote path exists but is not accessible to the SSH user.
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Remote shell snippet that prints the access status of "$p" as the first output line.
+// "$access" is a test that must pass for the path to be accessible.
+// Only "ok" is followed by the output of the rest of the script.
+const checkPath = `
+if [ ! -e "$p" ] && [ ! -L "$p" ]; then
+	# A path below an unsearchable directory cannot be seen, so check the nearest existing ancestor.
+	d=$(dirname "$p")
+	while [ ! -e "$d" ] && [ "$d" != / ] && [ "$d" != . ]; do d=$(dirname "$d"); done
+	if [ -d "$d" ] && [ ! -x "$d" ]; then echo permission-denied; else echo not-found; fi
+	exit 0
+fi
+if ! eval "$access"; then echo permission-denied; exit 0; fi
+echo ok
+`
+
+// Access tests for checkPath.
+const (
+	accessAny  = `true`
+	accessRead = `[ -r "$p" ] && { [ ! -d "$p" ] || [ -x "$p" ]; }`
+)
+
+// Remote file information
+type RemoteFileInfo struct {
+	// path on the remote server
+	Path string
+	// size in bytes
+	Size int
+	// permission bits in octal (e.g. 644)
+	Mode string
+	// owner user name
+	Owner string
+	// owner group name
+	Group string
+	// modification time in RFC 3339 format
+	ModTime string
+	// whether the path is a directory
+	IsDir bool
+}
+
+// Check whether a regular file exists on the remote server.
+// A missing file is reported as false, an inaccessible one as an error.
+func (s *SshCommander) FileExists(
+	ctx context.Context,
+	// remote file path
+	path string,
+) (bool, error) {
+	out, err := s.inspect(ctx, path, accessAny, `[ -f "$p" ] && echo true || echo false`)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(out) == "true", nil
+}
+
+// Read a file on the remote server.
+func (s *SshCommander) ReadFile(
+	ctx context.Context,
+	// remote file path
+	path string,
+) (string, error) {
+	return s.inspect(ctx, path, accessRead, `cat -- "$p"`)
+}
+
+// Read a file on the remote server as a secret.
+//
+// Note: The contents are not written to the command output, but do remain in the container that read them.
+func (s *SshCommander) ReadSecretFile(
+	ctx context.Context,
+	// remote file path
+	path string,
+) (*dagger.Secret, error) {
+	outPath := "/tmp/ssh-secret-file"
+
+	ctr, err := s.run(ctx, s.BaseCtr, "cat -- "+shellQuote(path), fmt.Sprintf(`%s %s > %s`, s.sshCommand(), shellQuote(inspectScript(path, accessRead, `cat -- "$p"`)), outPath))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ctr.File(outPath).Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := parseStatus(path, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret(fmt.Sprintf("ssh:%s:%s", s.Destination, path), contents), nil
+}
+
+// Get information about a file or directory on the remote server.
+func (s *SshCommander) Stat(
+	ctx context.Context,
+	// remote path
+	path string,
+) (*RemoteFileInfo, error) {
+	out, err := s.inspect(ctx, path, accessAny, `stat -c '%s %a %U %G %Y %F' -- "$p"`)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(out), " ", 6)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%s: unexpected stat output %q", path, out)
+	}
+
+	size, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid size %q", path, fields[0])
+	}
+	mtime, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid modification time %q", path, fields[4])
+	}
+
+	return &RemoteFileInfo{
+		Path:    path,
+		Size:    size,
+		Mode:    fields[1],
+		Owner:   fields[2],
+		Group:   fields[3],
+		ModTime: time.Unix(mtime, 0).UTC().Format(time.RFC3339),
+		IsDir:   fields[5] == "directory",
+	}, nil
+}
+
+// List the entries of a directory on the remote server.
+// Hidden entries are included, '.' and '..' are not.
+func (s *SshCommander) ListDir(
+	ctx context.Context,
+	// remote directory path
+	path string,
+) ([]string, error) {
+	out, err := s.inspect(ctx, path, accessRead, `[ -d "$p" ] || { echo "$p: not a directory" >&2; exit 1; }; ls -A1 -- "$p"`)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// Run script against path on the remote server and return its output.
+func (s *SshCommander) inspect(ctx context.Context, path string, access string, script string) (string, error) {
+	ctr, err := s.script(ctx, inspectScript(path, access, script))
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ctr.Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return parseStatus(path, out)
+}
+
+// Returns a remote script that runs script once path is known to be accessible.
+func inspectScript(path string, access string, script string) string {
+	return fmt.Sprintf("p=%s\naccess=%s\n%s%s\n", shellQuote(path), shellQuote(access), checkPath, script)
+}
+
+// Split the status line printed by checkPath from the rest of the output.
+func parseStatus(path string, out string) (string, error) {
+	status, rest, _ := strings.Cut(out, "\n")
+
+	switch status {
+	case "ok":
+		return rest, nil
+	case "not-found":
+		return "", fmt.Errorf("%s: %w", path, ErrNotFound)
+	case "permission-denied":
+		return "", fmt.Errorf("%s: %w", path, ErrPermissionDenied)
+	default:
+		return "", fmt.Errorf("%s: unexpected output %q", path, status)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Exit code of a remote command that could not acquire its lock (EX_TEMPFAIL).
+const lockExitCode = 75
+
+// Lock modes of lockSnippet
+const (
+	// take the lease for "$token"
+	lockAcquire = "acquire"
+	// remove the lease of "$token"
+	lockRelease = "release"
+	// hold the flock while the command runs, under the lease of "$token" if given
+	lockRun = "run"
+)
+
+// Remote shell snippet that coordinates pipelines through a flock on "$lock" and a lease in "$lock.lease".
+// The lease ('token expiry holder') keeps the lock for a sequence of commands:
+// while it is valid, only commands carrying its token may run, and each of them renews it.
+// Other commands wait for it to be released or to expire.
+// The holder is written into the lock file so that a waiting pipeline can name it on timeout.
+const lockSnippet = `
+command -v flock >/dev/null || { echo "flock is required on the remote server to use a lock" >&2; exit %[1]d; }
+exec 9>>"$lock" || exit %[1]d
+lease="$lock.lease"
+deadline=$(( $(date +%%s) + timeout ))
+while :; do
+	if ! flock -w "$timeout" 9; then
+		echo "could not acquire lock $lock within ${timeout}s, held by: $(cat "$lock")" >&2
+		exit %[1]d
+	fi
+	now=$(date +%%s)
+	t=; exp=0; h=
+	[ -f "$lease" ] && read -r t exp h < "$lease"
+	if [ -n "$token" ] && [ "$mode" != acquire ]; then
+		if [ "$t" != "$token" ] || { [ "$mode" = run ] && [ "$exp" -le "$now" ]; }; then
+			echo "lock $lock is no longer held by this pipeline (lease expired or taken over)" >&2
+			exit %[1]d
+		fi
+		break
+	fi
+	if [ -z "$t" ] || [ "$exp" -le "$now" ]; then
+		break
+	fi
+	flock -u 9
+	if [ "$now" -ge "$deadline" ]; then
+		echo "could not acquire lock $lock within ${timeout}s, held by: $h" >&2
+		exit %[1]d
+	fi
+	sleep 1
+done
+case "$mode" in
+acquire)
+	printf '%%s %%s %%s\n' "$token" $((now + ttl)) "$holder" > "$lease" || exit %[1]d
+	exit 0
+	;;
+release)
+	rm -f "$lease" || exit %[1]d
+	exit 0
+	;;
+esac
+if [ -n "$token" ]; then
+	printf '%%s %%s %%s\n' "$token" $((now + ttl)) "$holder" > "$lease" || exit %[1]d
+fi
+trap ': > "$lock"' EXIT
+printf '%%s (since %%s)\n' "$holder" "$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)" > "$lock"
+`
+
+var lockNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Use a lock on the remote server.
+// Each command run afterwards holds the lock while it runs; commands run by other pipelines with the same lock wait for it
+// to be released, and fail naming the current holder if the timeout expires.
+// To hold the lock across a sequence of commands, call Lock before and Unlock after them.
+//
+// Note: Requires flock on the remote server.
+func (s *SshCommander) WithLock(
+	// lock name, or an absolute path of the lock file on the remote server
+	// (A name is stored as '/tmp/dagger-lock-[name]')
+	name string,
+	// seconds to wait for the lock
+	// +optional
+	// +default=60
+	timeout int,
+	// holder name reported to pipelines waiting for the lock (e.g. a CI job URL)
+	// +optional
+	// +default="dagger pipeline"
+	holder string,
+) (*SshCommander, error) {
+	if !strings.HasPrefix(name, "/") && !lockNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid lock name %q: use letters, digits, '.', '_', '-' or an absolute path", name)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid lock timeout %d", timeout)
+	}
+
+	s.LockName = name
+	s.LockTimeout = timeout
+	s.LockHolder = holder
+	return s, nil
+}
+
+// Acquire the lock for the commands run afterwards, until Unlock.
+// Commands of other pipelines with the same lock wait in the meantime.
+// The lease expires if no command is run within its duration; a command run after that fails.
+func (s *SshCommander) Lock(
+	ctx context.Context,
+	// seconds the lease lasts after acquiring it and after each command
+	// +optional
+	// +default=600
+	lease int,
+) (*SshCommander, error) {
+	if s.LockName == "" {
+		return nil, errors.New("no lock configured: call WithLock first")
+	}
+	if s.LeaseToken != "" {
+		return nil, fmt.Errorf("lock %s is already held", s.LockName)
+	}
+	if lease <= 0 {
+		return nil, fmt.Errorf("invalid lease duration %d", lease)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	s.LeaseDuration = lease
+	if err := s.lock(ctx, lockAcquire, token); err != nil {
+		return nil, err
+	}
+	s.LeaseToken = token
+	return s, nil
+}
+
+// Release the lock acquired by Lock.
+func (s *SshCommander) Unlock(
+	ctx context.Context,
+) (*SshCommander, error) {
+	if s.LeaseToken == "" {
+		return nil, errors.New("lock is not held: call Lock first")
+	}
+
+	if err := s.lock(ctx, lockRelease, s.LeaseToken); err != nil {
+		return nil, err
+	}
+	s.LeaseToken = ""
+	return s, nil
+}
+
+// Run the lock snippet in the acquire or release mode.
+func (s *SshCommander) lock(ctx context.Context, mode string, token string) error {
+	script := s.lockScript(mode, token)
+	ctr, err := s.run(ctx, s.BaseCtr, fmt.Sprintf("%s lock %s", mode, s.LockName), fmt.Sprintf(`%s %s`, s.SshCommand, shellQuote(script)))
+	if err != nil {
+		return err
+	}
+	_, err = ctr.Sync(ctx)
+	return err
+}
+
+// Returns the remote script prefix of the lock mode.
+func (s *SshCommander) lockScript(mode string, token string) string {
+	path := s.LockName
+	if !strings.HasPrefix(path, "/") {
+		path = "/tmp/dagger-lock-" + s.LockName
+	}
+
+	return fmt.Sprintf("lock=%s\ntimeout=%d\nholder=%s\nmode=%s\ntoken=%s\nttl=%d\n",
+		shellQuote(path), s.LockTimeout, shellQuote(s.LockHolder), mode, token, s.LeaseDuration) +
+		fmt.Sprintf(lockSnippet, lockExitCode)
+}
@@ -6,9 +6,9 @@ package main
 import (
 	"context"
 	"dagger/ssh/internal/dagger"
-	"errors"
 	"fmt"
-	"time"
+	"strconv"
+	"strings"
 )
 
 // SSH dagger module
@@ -73,30 +73,80 @@ func (s *SshConfig) WithPassword(
 	// password
 	arg *dagger.Secret,
 ) (*SshCommander, error) {
-	passwordText, err := arg.Plaintext(ctx)
-	if err != nil {
-		return nil, errors.New("invalid password secret")
-	}
-
-	return &SshCommander{
-		BaseCtr:    s.BaseCtr,
-		SshCommand: fmt.Sprintf(`sshpass -p %s ssh -o StrictHostKeyChecking=no -o LogLevel=error -p %d %s`, passwordText, s.Port, s.Destination),
-	}, nil
+	return s.WithCredential(ctx, dag.SSHCredential().WithPassword(arg))
 }
 
 // Set up identity file with SSH connection credentials.
 //
 // Note: Tested against RSA-formatted and OPENSSH-formatted private keys.
 func (s *SshConfig) WithIdentityFile(
+	ctx context.Context,
 	// identity file
 	arg *dagger.Secret,
-) *SshCommander {
-	keyPath := "/identity_key"
+) (*SshCommander, error) {
+	return s.WithCredential(ctx, dag.SSHCredential().WithKey(arg))
+}
+
+// Set the SSH connection credentials.
+func (s *SshConfig) WithCredential(
+	ctx context.Context,
+	// credentials created with the ssh-credential module
+	credential *dagger.SSHCredential,
+) (*SshCommander, error) {
+	return s.withIdentity(ctx, credential.Identity(s.Destination))
+}
+
+// Set the SSH connection credentials to the identity of the keyring that matches the destination host.
+func (s *SshConfig) WithKeyring(
+	ctx context.Context,
+	// keyring created with the ssh-credential module
+	keyring *dagger.SSHCredentialKeyring,
+) (*SshCommander, error) {
+	return s.withIdentity(ctx, keyring.Identity(s.Destination))
+}
+
+// Returns a commander that connects with the credential of the identity, mounting its files at the path of the identity.
+func (s *SshConfig) withIdentity(ctx context.Context, identity *dagger.SSHCredentialIdentity) (*SshCommander, error) {
+	mountPath, err := identity.Path(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credential := identity.Credential()
+
+	args, err := credential.Command(ctx, "ssh", mountPath)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := credentialSecrets(ctx, credential)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, "-o", "LogLevel=error", "-p", strconv.Itoa(s.Port), s.Destination)
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
 
 	return &SshCommander{
-		BaseCtr:    s.BaseCtr.WithMountedSecret(keyPath, arg),
-		SshCommand: fmt.Sprintf(`ssh -i %s -o StrictHostKeyChecking=no -o LogLevel=error -p %d %s`, keyPath, s.Port, s.Destination),
+		BaseCtr:     credential.Mount(s.BaseCtr, mountPath),
+		SshCommand:  strings.Join(quoted, " "),
+		Destination: s.Destination,
+		Secrets:     secrets,
+	}, nil
+}
+
+// Returns the secrets of the credential to redact from the audit transcript.
+func credentialSecrets(ctx context.Context, credential *dagger.SSHCredential) ([]*dagger.Secret, error) {
+	list, err := credential.Secrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*dagger.Secret, len(list))
+	for i := range list {
+		secrets[i] = &list[i]
 	}
+	return secrets, nil
 }
 
 // SSH command launcher
@@ -105,6 +155,26 @@ type SshCommander struct {
 	BaseCtr *dagger.Container
 	// +private
 	SshCommand string
+	// +private
+	Destination string
+	// +private
+	Secrets []*dagger.Secret
+	// +private
+	Audit bool
+	// +private
+	CachePolicy string
+	// +private
+	CacheKey string
+	// +private
+	LockName string
+	// +private
+	LockTimeout int
+	// +private
+	LockHolder string
+	// +private
+	LeaseToken string
+	// +private
+	LeaseDuration int
 }
 
 // Returns a container that is ready to launch SSH command.
@@ -112,18 +182,105 @@ func (s *SshCommander) Container() *dagger.Container {
 	return s.BaseCtr
 }
 
+// Set the cache policy for commands run afterwards.
+// By default every command runs again on each call.
+// Use the "key" policy to reuse results while the key (e.g. a version string or a checksum) stays the same,
+// or the "forever" policy to run an idempotent command only once.
+func (s *SshCommander) WithCachePolicy(
+	// cache policy: always, key or forever
+	policy string,
+	// cache key, required by the "key" policy
+	// +optional
+	key string,
+) (*SshCommander, error) {
+	if err := validateCachePolicy(policy, key); err != nil {
+		return nil, err
+	}
+
+	s.CachePolicy = policy
+	s.CacheKey = key
+	return s, nil
+}
+
+// Enable audit mode.
+// Every command run afterwards is appended as a JSON line to a transcript inside the returned container,
+// with the destination, the command, timestamps, exit code and output byte counts.
+// Values of the credential secret and of the given secrets are redacted from the transcript.
+//
+// To keep a single transcript across several commands, pass the returned container as the base container of the next Config.
+//
+// Note: A failing command is recorded with its exit code, and the error returned for it contains its audit record and stderr,
+// since no container is returned to read the transcript from.
+func (s *SshCommander) WithAudit(
+	// additional secrets to redact from the transcript
+	// +optional
+	redact []*dagger.Secret,
+) *SshCommander {
+	s.Audit = true
+	s.Secrets = append(s.Secrets, redact...)
+	return s
+}
+
+// Returns the audit transcript from a container returned in audit mode.
+func (s *SshCommander) AuditLog(
+	// container returned by a command run in audit mode
+	ctr *dagger.Container,
+) *dagger.File {
+	return ctr.File(AuditLogPath)
+}
+
 // Run the command on the remote server.
 func (s *SshCommander) Command(
+	ctx context.Context,
 	// command
 	arg string,
-) *dagger.Container {
-	exec := s.BaseCtr.
-		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
-		WithExec([]string{
-			"bash",
-			"-c",
-			fmt.Sprintf(`%s "%s"`, s.SshCommand, arg),
-		})
-
-	return exec
+) (*dagger.Container, error) {
+	return s.run(ctx, s.BaseCtr, arg, fmt.Sprintf(`%s "%s"`, s.sshCommand(), arg))
+}
+
+// Run a script on the remote server, passing it to ssh as a single quoted argument.
+func (s *SshCommander) script(ctx context.Context, script string) (*dagger.Container, error) {
+	return s.run(ctx, s.BaseCtr, script, fmt.Sprintf(`%s %s`, s.sshCommand(), shellQuote(script)))
+}
+
+// Run a script on the remote server with input as its standard input.
+func (s *SshCommander) scriptWithInput(ctx context.Context, script string, input string) (*dagger.Container, error) {
+	inputPath := "/tmp/ssh-stdin"
+
+	return s.run(ctx, s.BaseCtr.WithNewFile(inputPath, input), script, fmt.Sprintf(`%s %s < %s`, s.sshCommand(), shellQuote(script), inputPath))
+}
+
+// Run the local command line that invokes ssh in ctr.
+// command is the remote command as recorded in the audit transcript.
+func (s *SshCommander) run(ctx context.Context, ctr *dagger.Container, command string, commandLine string) (*dagger.Container, error) {
+	ctr = ctr.With(withCachePolicy(s.CachePolicy, s.CacheKey))
+	cmd := []string{"bash", "-c", commandLine}
+
+	if !s.Audit {
+		return ctr.WithExec(cmd), nil
+	}
+
+	command, err := redact(ctx, command, s.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return auditExec(ctx, ctr, auditEntry{
+		Destination: s.Destination,
+		Command:     command,
+	}, cmd)
+}
+
+// Returns the local command line prefix that invokes ssh,
+// followed by the remote lock prefix when a lock is configured.
+func (s *SshCommander) sshCommand() string {
+	if s.LockName == "" {
+		return s.SshCommand
+	}
+	return fmt.Sprintf(`%s %s`, s.SshCommand, shellQuote(s.lockScript(lockRun, s.LeaseToken)))
+}
+
+// Quote s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
 }